@@ -8,13 +8,63 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
+// Block Lines of the inputs.
+type Block struct {
+	Lines []string
+	// Offsets position in bytes of every line in its input, it can be nil if it is unknown.
+	Offsets []int64
+	// Line number of the first line in its input.
+	Line int
+	// Source name of the input of the first line.
+	Source string
+	// Spans where the lines come from, in order. If it is nil, all the lines are
+	// consecutive lines of Source starting at Line. It is always set on the batches of Out.
+	Spans []Span
+	// Seq position of the batch in Out, starting at 0.
+	Seq int
+}
+
+// Span Consecutive lines of a block read from the same input.
+type Span struct {
+	Source string
+	// Line number of the first line in the input.
+	Line int
+	// Len number of lines.
+	Len int
+}
+
+// RowSpans returns where the lines of the block come from.
+func (b Block) RowSpans() []Span {
+	if b.Spans != nil {
+		return b.Spans
+	}
+	return []Span{{Source: b.Source, Line: b.Line, Len: len(b.Lines)}}
+}
+
+// AddSpan Record that the next lines added to the block come from s.
+// It extends the last span if s follows it in the same input.
+func (b *Block) AddSpan(s Span) {
+	if s.Len == 0 {
+		return
+	}
+	if len(b.Spans) == 0 {
+		b.Line, b.Source = s.Line, s.Source
+	}
+	if last := len(b.Spans) - 1; last >= 0 && b.Spans[last].Source == s.Source && b.Spans[last].Line+b.Spans[last].Len == s.Line {
+		b.Spans[last].Len += s.Len
+		return
+	}
+	b.Spans = append(b.Spans, s)
+}
+
 // BatchingChannel implements the Channel interface, with the change that instead of producing individual elements
 // on Out(), it batches together the entire internal buffer each time. Trying to construct an unbuffered batching channel
 // will panic, that configuration is not supported (and provides no benefit over an unbuffered NativeChannel).
+// Rows are received in blocks of raw lines, their keys are only allocated by the workers of ProcessOut.
 type BatchingChannel struct {
-	input     chan string
-	output    chan vector.Vector
-	buffer    vector.Vector
+	input     chan Block
+	output    chan Block
+	buffer    Block
 	allocate  *vector.Allocate
 	g         *errgroup.Group
 	sem       *semaphore.Weighted
@@ -32,8 +82,8 @@ func NewBatchingChannel(ctx context.Context, allocate *vector.Allocate, maxWorke
 	}
 	g, dCtx := errgroup.WithContext(ctx)
 	ch := &BatchingChannel{
-		input:     make(chan string),
-		output:    make(chan vector.Vector),
+		input:     make(chan Block),
+		output:    make(chan Block),
 		size:      size,
 		allocate:  allocate,
 		maxWorker: maxWorker,
@@ -45,26 +95,47 @@ func NewBatchingChannel(ctx context.Context, allocate *vector.Allocate, maxWorke
 	return ch
 }
 
-func (ch *BatchingChannel) In() chan<- string {
+// In returns the channel receiving blocks of lines. Blocks can have any length,
+// the order of the lines is kept in the batches. Blocks of several inputs can be sent at the same time.
+func (ch *BatchingChannel) In() chan<- Block {
 	return ch.input
 }
 
-// Out returns a <-chan vector.Vector in order that BatchingChannel conforms to the standard Channel interface provided
-// by this package, however each output value is guaranteed to be of type vector.Vector - a vector collecting the most
-// recent batch of values sent on the In channel. The vector is guaranteed to not be empty or nil.
-func (ch *BatchingChannel) Out() <-chan vector.Vector {
+// Out returns a <-chan Block collecting the most recent batch of lines sent on the In channel.
+// The batch is guaranteed to not be empty.
+func (ch *BatchingChannel) Out() <-chan Block {
 	return ch.output
 }
 
+// ProcessOut Call f with a vector for every batch, using at most maxWorker goroutines.
+// The keys of the rows are allocated in those goroutines, in the order of the lines.
 func (ch *BatchingChannel) ProcessOut(f func(vector.Vector) error) error {
-	for val := range ch.Out() {
+	return ch.ProcessBlocks(func(b Block) error {
+		v := ch.allocate.Vector(len(b.Lines), ch.allocate.Key)
+		for _, line := range b.Lines {
+			err := v.PushBack(line)
+			if err != nil {
+				return err
+			}
+		}
+		return f(v)
+	})
+}
+
+// ProcessBlocks Call f with every batch of raw lines, using at most maxWorker goroutines.
+func (ch *BatchingChannel) ProcessBlocks(f func(Block) error) error {
+	for b := range ch.Out() {
 		if err := ch.sem.Acquire(ch.dCtx, 1); err != nil {
+			// report the error of the worker that stopped the others
+			if werr := ch.g.Wait(); werr != nil {
+				return werr
+			}
 			return err
 		}
-		val := val
+		b := b
 		ch.g.Go(func() error {
 			defer ch.sem.Release(1)
-			return f(val)
+			return f(b)
 		})
 	}
 	err := ch.g.Wait()
@@ -86,28 +157,62 @@ func (ch *BatchingChannel) Close() {
 	close(ch.input)
 }
 
+// Done returns a channel closed once a worker failed or the context is canceled.
+// Nothing is read from In after that.
+func (ch *BatchingChannel) Done() <-chan struct{} {
+	return ch.dCtx.Done()
+}
+
+// send Hand a batch to the workers. It returns false if they stopped.
+func (ch *BatchingChannel) send(b Block) bool {
+	select {
+	case ch.output <- b:
+		return true
+	case <-ch.dCtx.Done():
+		return false
+	}
+}
+
 func (ch *BatchingChannel) batchingBuffer() {
-	ch.buffer = ch.allocate.Vector(ch.size, ch.allocate.Key)
-	for {
-		elem, open := <-ch.input
-		if open {
-			err := ch.buffer.PushBack(elem)
-			if err != nil {
-				ch.g.Go(func() error {
-					return err
-				})
+	defer close(ch.output)
+	ch.buffer = Block{Lines: make([]string, 0, ch.size)}
+	for block := range ch.input {
+		// the spans are consumed, they are copied to leave the block of the sender untouched
+		spans := append([]Span(nil), block.RowSpans()...)
+		for len(block.Lines) > 0 {
+			n := ch.size - len(ch.buffer.Lines)
+			if n > len(block.Lines) {
+				n = len(block.Lines)
 			}
-		} else {
-			if ch.buffer.Len() > 0 {
-				ch.output <- ch.buffer
+			ch.buffer.Lines = append(ch.buffer.Lines, block.Lines[:n]...)
+			block.Lines = block.Lines[n:]
+			if block.Offsets != nil {
+				ch.buffer.Offsets = append(ch.buffer.Offsets, block.Offsets[:n]...)
+				block.Offsets = block.Offsets[n:]
+			}
+			// move the spans of the n lines to the batch
+			for taken := 0; taken < n; {
+				s := spans[0]
+				if s.Len > n-taken {
+					s.Len = n - taken
+				}
+				ch.buffer.AddSpan(s)
+				spans[0].Line += s.Len
+				spans[0].Len -= s.Len
+				if spans[0].Len == 0 {
+					spans = spans[1:]
+				}
+				taken += s.Len
+			}
+			if len(ch.buffer.Lines) == ch.size {
+				if !ch.send(ch.buffer) {
+					return
+				}
+				ch.buffer = Block{Lines: make([]string, 0, ch.size), Seq: ch.buffer.Seq + 1}
 			}
-			break
-		}
-		if ch.buffer.Len() == ch.size {
-			ch.output <- ch.buffer
-			ch.buffer = ch.allocate.Vector(ch.size, ch.allocate.Key)
 		}
 	}
-
-	close(ch.output)
+	if len(ch.buffer.Lines) > 0 {
+		ch.send(ch.buffer)
+	}
 }
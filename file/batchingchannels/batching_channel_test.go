@@ -44,7 +44,7 @@ func testBatches(t *testing.T, ch *batchingchannels.BatchingChannel) {
 		go func(j int) {
 			defer wgInput.Done()
 			for i := maxI / maxIn * j; i < maxI*(j+1)/maxIn; i++ {
-				ch.In() <- strconv.Itoa(i)
+				ch.In() <- batchingchannels.Block{Lines: []string{strconv.Itoa(i)}}
 			}
 		}(j)
 	}
@@ -111,10 +111,41 @@ func testChannelConcurrentAccessors(t *testing.T, name string, ch *batchingchann
 	go ch.Cap()
 
 	go func() {
-		ch.In() <- ""
+		ch.In() <- batchingchannels.Block{Lines: []string{""}}
 	}()
 
 	go func() {
 		<-ch.Out()
 	}()
 }
+
+func TestBatchingChannelBlocks(t *testing.T) {
+	allocate := vector.DefaultVector(AllocateInt)
+	ch := batchingchannels.NewBatchingChannel(context.Background(), allocate, 1, 4)
+	go func() {
+		i := 0
+		for _, size := range []int{1, 3, 9, 0, 2} {
+			block := batchingchannels.Block{Line: i + 1}
+			for j := 0; j < size; j++ {
+				block.Lines = append(block.Lines, strconv.Itoa(i))
+				block.Offsets = append(block.Offsets, int64(i*3))
+				i++
+			}
+			ch.In() <- block
+		}
+		ch.Close()
+	}()
+	got := [][]string{}
+	err := ch.ProcessBlocks(func(b batchingchannels.Block) error {
+		assert.Len(t, b.Offsets, len(b.Lines))
+		for i, line := range b.Lines {
+			// every line is at its position in the input
+			assert.Equal(t, strconv.Itoa(b.Line+i-1), line)
+			assert.Equal(t, int64((b.Line+i-1)*3), b.Offsets[i])
+		}
+		got = append(got, b.Lines)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"0", "1", "2", "3"}, {"4", "5", "6", "7"}, {"8", "9", "10", "11"}, {"12", "13", "14"}}, got)
+}
@@ -0,0 +1,216 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/askiada/external-sort/file/chunkfile"
+	"github.com/pkg/errors"
+)
+
+// run A sorted chunk file, written from a batch of rows or merged from smaller runs.
+// A run without path stands for a batch whose rows were all dropped, it only keeps the order of the runs.
+type run struct {
+	path   string
+	dir    int
+	footer *chunkfile.Footer
+	// seq position of the run among the runs of its level, in the order of the input.
+	seq int
+}
+
+// size returns the number of bytes of the run on disk.
+func (r run) size() int64 {
+	return int64(chunkfile.FooterSize + r.footer.Size + r.footer.IndexSize)
+}
+
+// mergedRun The result of a cascade merge.
+type mergedRun struct {
+	run   run
+	level int
+	err   error
+}
+
+// cascade Merge the chunks into larger runs while the input is still being read.
+// Every time factor consecutive runs of the same level are written, they are merged into one run of the next level,
+// so the final merge only combines a few large runs. Only consecutive runs are merged, so rows with equal keys
+// keep the order of the input.
+type cascade struct {
+	ctx    context.Context
+	info   *Info
+	placer *placer
+	factor int
+	// k number of rows buffered per run during a merge.
+	k      int
+	levels [][]run
+	// waiting runs of every level written before the runs preceding them, by seq.
+	waiting []map[int]run
+	// next seq of the next run of every level to add to the level.
+	next []int
+	// merges number of merges started from every level.
+	merges []int
+	add    chan run
+	merged chan mergedRun
+	done   chan struct{}
+	err    error
+	count  int
+}
+
+// newCascade Start merging the runs added to the cascade.
+func (f *Info) newCascade(ctx context.Context, p *placer, factor, k int) *cascade {
+	c := &cascade{
+		ctx:    ctx,
+		info:   f,
+		placer: p,
+		factor: factor,
+		k:      k,
+		add:    make(chan run),
+		merged: make(chan mergedRun),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *cascade) run() {
+	defer close(c.done)
+	pending := 0
+	add := c.add
+	for add != nil || pending > 0 {
+		select {
+		case r, ok := <-add:
+			if !ok {
+				add = nil
+				continue
+			}
+			pending += c.push(0, r)
+		case m := <-c.merged:
+			pending--
+			if m.err != nil {
+				if c.err == nil {
+					c.err = m.err
+				}
+				continue
+			}
+			pending += c.push(m.level, m.run)
+		}
+	}
+}
+
+// push Add a run to a level, once the runs before it were added, and merge the level once it holds factor runs.
+// It returns the number of merges started.
+func (c *cascade) push(level int, r run) int {
+	for len(c.levels) <= level {
+		c.levels = append(c.levels, nil)
+		c.waiting = append(c.waiting, map[int]run{})
+		c.next = append(c.next, 0)
+		c.merges = append(c.merges, 0)
+	}
+	c.waiting[level][r.seq] = r
+	started := 0
+	for {
+		r, ok := c.waiting[level][c.next[level]]
+		if !ok {
+			return started
+		}
+		delete(c.waiting[level], c.next[level])
+		c.next[level]++
+		if r.path == "" {
+			continue
+		}
+		c.levels[level] = append(c.levels[level], r)
+		if len(c.levels[level]) < c.factor || c.err != nil {
+			continue
+		}
+		runs := c.levels[level]
+		c.levels[level] = nil
+		seq := c.merges[level]
+		c.merges[level]++
+		c.count++
+		name := "run_" + strconv.Itoa(level+1) + "_" + strconv.Itoa(c.count) + ".tsv"
+		go func() {
+			merged, err := c.merge(runs, name)
+			merged.seq = seq
+			c.merged <- mergedRun{run: merged, level: level + 1, err: err}
+		}()
+		started++
+	}
+}
+
+// merge Merge the runs into a new run named name and remove them.
+func (c *cascade) merge(runs []run, name string) (merged run, err error) {
+	size := int64(0)
+	chunkPaths := make([]string, 0, len(runs))
+	for _, r := range runs {
+		size += r.size()
+		chunkPaths = append(chunkPaths, r.path)
+	}
+	dirIdx, err := c.placer.reserve(size)
+	if err != nil {
+		return merged, err
+	}
+	defer func() {
+		if err != nil {
+			c.placer.release(dirIdx, size)
+		}
+	}()
+	chunks := &chunks{
+		list:      make([]*chunkInfo, 0, len(runs)),
+		keepFiles: true,
+		metrics:   c.info.metrics(),
+	}
+	err = chunks.open(wholeChunks(chunkPaths), c.info.Allocate, c.k)
+	if err != nil {
+		return merged, err
+	}
+	defer chunks.close()
+	runPath := path.Join(c.info.job.dirs[dirIdx], name)
+	w, err := c.info.createChunk(runPath)
+	if err != nil {
+		return merged, err
+	}
+	// the progress of the cascade is not reported
+	err = c.info.merge(c.ctx, chunks, c.k, chunkWriter{w}, NoProgress{})
+	if err != nil {
+		w.Abort()
+		return merged, err
+	}
+	footer, err := w.Close()
+	if err != nil {
+		os.Remove(runPath)
+		return merged, err
+	}
+	merged = run{path: runPath, dir: dirIdx, footer: footer}
+	c.info.metrics().AddChunksWritten(1)
+	c.info.addChunkBytes(merged.size())
+	for _, r := range runs {
+		err = os.Remove(r.path)
+		if err != nil {
+			return merged, err
+		}
+		c.placer.release(r.dir, r.size())
+		c.info.addChunkBytes(-r.size())
+	}
+	return merged, nil
+}
+
+// close Wait for the pending merges and return the runs left to merge, in the order of the input.
+// Runs still waiting for the runs before them are an error, their rows would be lost.
+func (c *cascade) close() ([]run, error) {
+	close(c.add)
+	<-c.done
+	if c.err != nil {
+		return nil, c.err
+	}
+	for level, waiting := range c.waiting {
+		if len(waiting) > 0 {
+			return nil, errors.Errorf("cascade: %d runs of level %d are waiting for run %d", len(waiting), level, c.next[level])
+		}
+	}
+	runs := []run{}
+	for level := len(c.levels) - 1; level >= 0; level-- {
+		runs = append(runs, c.levels[level]...)
+	}
+	return runs, nil
+}
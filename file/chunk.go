@@ -1,87 +1,200 @@
 package file
 
 import (
-	"bufio"
 	"os"
 	"sort"
 
+	"github.com/askiada/external-sort/file/chunkfile"
 	"github.com/askiada/external-sort/vector"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/pkg/errors"
 )
 
 // chunkInfo Describe a chunk.
 type chunkInfo struct {
-	file     *os.File
-	scanner  *bufio.Scanner
+	reader   *chunkfile.Reader
 	buffer   vector.Vector
 	filename string
+	// order position of the chunk in the merge, rows with equal keys are taken from the first chunk first.
+	order int
+	// readAhead is set when the next rows are read in the background.
+	readAhead *readAhead
 }
 
-// pullSubset Add to vector the specified number of elements.
+// pullSubset Add to the chunk buffer the specified number of elements.
 // It stops if there is no elements left to add.
-func (c *chunkInfo) pullSubset(size int) (err error) {
+// With read-ahead, the buffer is replaced by the batch read in the background.
+func (c *chunkInfo) pullSubset(size int) error {
+	if c.readAhead == nil {
+		return c.pull(c.buffer, size)
+	}
+	b := c.readAhead.take()
+	c.buffer = b.buffer
+	return b.err
+}
+
+// pull Add to vector the specified number of elements read from the chunk file.
+func (c *chunkInfo) pull(v vector.Vector, size int) (err error) {
 	i := 0
-	for i < size && c.scanner.Scan() {
-		text := c.scanner.Text()
-		c.buffer.PushBack(text)
+	for i < size && c.reader.Scan() {
+		text := c.reader.Text()
+		err = v.PushBack(text)
+		if err != nil {
+			return err
+		}
 		i++
 	}
-	if c.scanner.Err() != nil {
-		return c.scanner.Err()
+	if c.reader.Err() != nil {
+		return c.reader.Err()
 	}
 	return nil
 }
 
+// close Stop reading ahead and close the chunk file.
+func (c *chunkInfo) close() error {
+	if c.readAhead != nil {
+		c.readAhead.stop()
+		c.readAhead = nil
+	}
+	return c.reader.Close()
+}
+
 // chunks Pull of chunks.
 type chunks struct {
 	list []*chunkInfo
+	// keepFiles do not remove the chunk files once consumed.
+	keepFiles bool
+	// metrics count the chunk files open.
+	metrics Metrics
 }
 
-// new Create a new chunk and initialize it.
-func (c *chunks) new(chunkPath string, allocate *vector.Allocate, size int) error {
-	f, err := os.Open(chunkPath)
+// openParallelism maximum number of chunks opened and filled at the same time.
+const openParallelism = 16
+
+// section Rows of a chunk file between the offsets start and end.
+// A section with a negative end covers the whole chunk.
+type section struct {
+	path       string
+	start, end int64
+	// index of the chunk, used to verify the rows of a section.
+	index []chunkfile.IndexEntry
+}
+
+// wholeChunks returns a section covering every chunk.
+func wholeChunks(chunkPaths []string) []section {
+	sections := make([]section, 0, len(chunkPaths))
+	for _, chunkPath := range chunkPaths {
+		sections = append(sections, section{path: chunkPath, end: -1})
+	}
+	return sections
+}
+
+// newChunkInfo Open a chunk section and fill its buffer.
+// For a whole chunk, the footer is checked when it is opened, the row count and the checksum
+// are verified once all its rows have been pulled. The rows of a section are verified against the index.
+func newChunkInfo(s section, allocate *vector.Allocate, size int) (*chunkInfo, error) {
+	var reader *chunkfile.Reader
+	var err error
+	if s.end < 0 {
+		reader, err = chunkfile.Open(s.path)
+	} else {
+		reader, err = chunkfile.OpenSection(s.path, s.index, s.start, s.end)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	scanner := bufio.NewScanner(f)
 	elem := &chunkInfo{
-		filename: chunkPath,
-		file:     f,
-		scanner:  scanner,
+		filename: s.path,
+		reader:   reader,
 		buffer:   allocate.Vector(size, allocate.Key),
 	}
 	err = elem.pullSubset(size)
 	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return elem, nil
+}
+
+// open Create a chunk for every section and initialize it.
+// Chunks are opened in parallel so chunks spread across several disks are read at the same time.
+// Empty chunks are closed right away.
+func (c *chunks) open(sections []section, allocate *vector.Allocate, size int) error {
+	list := make([]*chunkInfo, len(sections))
+	g := &errgroup.Group{}
+	sem := make(chan struct{}, openParallelism)
+	for i, s := range sections {
+		i, s := i, s
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			elem, err := newChunkInfo(s, allocate, size)
+			if elem != nil {
+				elem.order = i
+				c.metrics.AddOpenChunks(1)
+			}
+			list[i] = elem
+			return err
+		})
+	}
+	err := g.Wait()
+	for _, elem := range list {
+		if elem == nil {
+			continue
+		}
+		if err == nil && elem.buffer.Len() == 0 {
+			c.metrics.AddOpenChunks(-1)
+			err = elem.close()
+			continue
+		}
+		c.list = append(c.list, elem)
+	}
+	if err != nil {
+		c.close()
 		return err
 	}
-	c.list = append(c.list, elem)
 	return nil
 }
 
+// startReadAhead Read the next rows of every chunk in the background, within the memory budget.
+// budget can be nil if the memory is not limited.
+func (c *chunks) startReadAhead(allocate *vector.Allocate, size int, budget *semaphore.Weighted) {
+	for _, chunk := range c.list {
+		chunk.startReadAhead(allocate, size, budget)
+	}
+}
+
 // close Close the file descriptors of all the chunks.
 func (c *chunks) close() error {
+	var err error
 	for _, chunk := range c.list {
-		err := chunk.file.Close()
-		if err != nil {
-			return errors.Wrap(err, "close")
+		c.metrics.AddOpenChunks(-1)
+		cerr := chunk.close()
+		if err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "close")
 		}
 	}
-	return nil
+	c.list = nil
+	return err
 }
 
 // shrink Remove all the chunks at the specified indexes
-// it removes the local file created and close the file descriptor.
+// it removes the local file created, unless keepFiles is set, and close the file descriptor.
 func (c *chunks) shrink(toShrink []int) error {
 	for i, shrinkIndex := range toShrink {
 		shrinkIndex -= i
-		err := c.list[shrinkIndex].file.Close()
+		c.metrics.AddOpenChunks(-1)
+		err := c.list[shrinkIndex].close()
 		if err != nil {
 			return err
 		}
-		err = os.Remove(c.list[shrinkIndex].filename)
-		if err != nil {
-			return err
+		if !c.keepFiles {
+			err = os.Remove(c.list[shrinkIndex].filename)
+			if err != nil {
+				return err
+			}
 		}
 		// we want to preserve order
 		c.list = append(c.list[:shrinkIndex], c.list[shrinkIndex+1:]...)
@@ -94,12 +207,22 @@ func (c *chunks) len() int {
 	return len(c.list)
 }
 
+// less returns true if the first row of a comes before the first row of b.
+// Rows with equal keys come in the order of the chunks.
+func less(a, b *chunkInfo) bool {
+	x, y := a.buffer.Get(0), b.buffer.Get(0)
+	if vector.Less(x, y) {
+		return true
+	}
+	return a.order < b.order && !vector.Less(y, x)
+}
+
 // resetOrder Put all the chunks in ascending order
 // Compare the first element of each chunk.
 func (c *chunks) resetOrder() {
 	if len(c.list) > 1 {
 		sort.Slice(c.list, func(i, j int) bool {
-			return vector.Less(c.list[i].buffer.Get(0), c.list[j].buffer.Get(0))
+			return less(c.list[i], c.list[j])
 		})
 	}
 }
@@ -109,7 +232,7 @@ func (c *chunks) moveFirstChunkToCorrectIndex() {
 	elem := c.list[0]
 	c.list = c.list[1:]
 	pos := sort.Search(len(c.list), func(i int) bool {
-		return !vector.Less(c.list[i].buffer.Get(0), elem.buffer.Get(0))
+		return less(elem, c.list[i])
 	})
 	// TODO: c.list = c.list[1:] and the following line create an unecessary allocation.
 	c.list = append(c.list[:pos], append([]*chunkInfo{elem}, c.list[pos:]...)...)
@@ -0,0 +1,515 @@
+// Package chunkfile reads and writes the sorted chunk files created during an external sort.
+//
+// A chunk file contains one row per line, or binary rows preceded by their length,
+// followed by a sparse index and a fixed size footer.
+// The footer stores the number of rows, the size of the data and its checksum,
+// so a truncated or corrupted chunk is detected instead of producing a wrong sort.
+// The index records the offset of every IndexInterval-th row and the checksum of the rows
+// up to the next entry, so a chunk can be binary searched and read from the middle
+// while the rows read are still verified.
+package chunkfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/askiada/external-sort/file/framing"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// FooterSize is the size in bytes of the footer appended to every chunk file.
+	FooterSize = 37
+	// IndexInterval number of rows between two entries of the index.
+	IndexInterval = 256
+)
+
+var (
+	footerMagic = []byte("XSC4")
+	crcTable    = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Footer describes the content of a chunk file.
+type Footer struct {
+	// Rows number of rows in the chunk.
+	Rows uint64
+	// Size number of bytes of rows.
+	Size uint64
+	// IndexSize number of bytes of the index, stored after the rows.
+	IndexSize uint64
+	// Checksum CRC-32 (Castagnoli) of the rows.
+	Checksum uint32
+	// IndexChecksum CRC-32 (Castagnoli) of the index.
+	IndexChecksum uint32
+	// Binary rows are preceded by their length instead of being followed by a newline.
+	Binary bool
+}
+
+func (ft *Footer) marshal() []byte {
+	b := make([]byte, FooterSize)
+	copy(b, footerMagic)
+	binary.LittleEndian.PutUint64(b[4:], ft.Rows)
+	binary.LittleEndian.PutUint64(b[12:], ft.Size)
+	binary.LittleEndian.PutUint32(b[20:], ft.Checksum)
+	binary.LittleEndian.PutUint64(b[24:], ft.IndexSize)
+	binary.LittleEndian.PutUint32(b[32:], ft.IndexChecksum)
+	if ft.Binary {
+		b[36] = 1
+	}
+	return b
+}
+
+func (ft *Footer) unmarshal(b []byte) error {
+	if len(b) != FooterSize || !bytes.Equal(b[:4], footerMagic) {
+		return errors.New("invalid chunk footer")
+	}
+	ft.Rows = binary.LittleEndian.Uint64(b[4:])
+	ft.Size = binary.LittleEndian.Uint64(b[12:])
+	ft.Checksum = binary.LittleEndian.Uint32(b[20:])
+	ft.IndexSize = binary.LittleEndian.Uint64(b[24:])
+	ft.IndexChecksum = binary.LittleEndian.Uint32(b[32:])
+	ft.Binary = b[36] == 1
+	return nil
+}
+
+// IndexEntry A row of the chunk and its position.
+type IndexEntry struct {
+	Line string
+	// Offset position of the row from the beginning of the file.
+	Offset int64
+	// Checksum CRC-32 (Castagnoli) of the rows from this one to the row of the next entry.
+	Checksum uint32
+}
+
+// marshalIndex Encode the entries as a uvarint offset, a little endian checksum
+// and a uvarint length followed by the line.
+func marshalIndex(entries []IndexEntry) []byte {
+	b := []byte{}
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, entry := range entries {
+		n := binary.PutUvarint(tmp, uint64(entry.Offset))
+		b = append(b, tmp[:n]...)
+		binary.LittleEndian.PutUint32(tmp, entry.Checksum)
+		b = append(b, tmp[:4]...)
+		n = binary.PutUvarint(tmp, uint64(len(entry.Line)))
+		b = append(b, tmp[:n]...)
+		b = append(b, entry.Line...)
+	}
+	return b
+}
+
+func unmarshalIndex(b []byte) ([]IndexEntry, error) {
+	entries := []IndexEntry{}
+	for len(b) > 0 {
+		offset, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid chunk index")
+		}
+		b = b[n:]
+		if len(b) < 4 {
+			return nil, errors.New("invalid chunk index")
+		}
+		checksum := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		length, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < length {
+			return nil, errors.New("invalid chunk index")
+		}
+		b = b[n:]
+		entries = append(entries, IndexEntry{Offset: int64(offset), Checksum: checksum, Line: string(b[:length])})
+		b = b[length:]
+	}
+	return entries, nil
+}
+
+// rowFraming returns how the rows of a chunk are delimited.
+func rowFraming(binary bool) framing.Framing {
+	if binary {
+		return framing.LengthPrefixed
+	}
+	return framing.Newline
+}
+
+// RowSize returns the number of bytes used by a row in a chunk, binary or not.
+func RowSize(line string, binary bool) int64 {
+	return rowFraming(binary).Size(line)
+}
+
+// IndexEntrySize returns the number of bytes used by the index entry of a row starting at offset.
+func IndexEntrySize(line string, offset int64) int64 {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	return int64(binary.PutUvarint(tmp, uint64(offset)) + 4 + binary.PutUvarint(tmp, uint64(len(line))) + len(line))
+}
+
+// Writer writes rows to a chunk file.
+type Writer struct {
+	file    *os.File
+	buffer  *bufio.Writer
+	hash    hash.Hash32
+	index   []IndexEntry
+	footer  Footer
+	sync    bool
+	framing framing.Framing
+	framed  []byte
+}
+
+// Create Create or truncate a chunk file storing one row per line.
+// If sync is true, the file is fsynced when closed.
+func Create(filename string, sync bool) (*Writer, error) {
+	return create(filename, sync, false)
+}
+
+// CreateBinary Create or truncate a chunk file storing every row after its length,
+// so rows can contain newlines or any other byte.
+// If sync is true, the file is fsynced when closed.
+func CreateBinary(filename string, sync bool) (*Writer, error) {
+	return create(filename, sync, true)
+}
+
+func create(filename string, sync, binary bool) (*Writer, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating file")
+	}
+	w := &Writer{
+		file:    f,
+		hash:    crc32.New(crcTable),
+		sync:    sync,
+		footer:  Footer{Binary: binary},
+		framing: rowFraming(binary),
+	}
+	w.buffer = bufio.NewWriter(io.MultiWriter(f, w.hash))
+	return w, nil
+}
+
+// WriteRow Add a row at the end of the chunk.
+func (w *Writer) WriteRow(line string) error {
+	var err error
+	w.framed, err = w.framing.Append(w.framed[:0], line)
+	if err != nil {
+		return err
+	}
+	if w.footer.Rows%IndexInterval == 0 {
+		w.index = append(w.index, IndexEntry{Line: line, Offset: int64(w.footer.Size)})
+	}
+	last := &w.index[len(w.index)-1]
+	last.Checksum = crc32.Update(last.Checksum, crcTable, w.framed)
+	n, err := w.buffer.Write(w.framed)
+	w.footer.Size += uint64(n)
+	if err != nil {
+		return errors.Wrap(err, "failed writing file")
+	}
+	w.footer.Rows++
+	return nil
+}
+
+// Close Write the index and the footer, flush everything to the file and close it.
+// It returns the footer written at the end of the chunk.
+func (w *Writer) Close() (*Footer, error) {
+	err := w.buffer.Flush()
+	if err != nil {
+		w.file.Close()
+		return nil, errors.Wrap(err, "failed flushing file")
+	}
+	w.footer.Checksum = w.hash.Sum32()
+	index := marshalIndex(w.index)
+	w.footer.IndexSize = uint64(len(index))
+	w.footer.IndexChecksum = crc32.Checksum(index, crcTable)
+	_, err = w.file.Write(append(index, w.footer.marshal()...))
+	if err != nil {
+		w.file.Close()
+		return nil, errors.Wrap(err, "failed writing footer")
+	}
+	if w.sync {
+		err = w.file.Sync()
+		if err != nil {
+			w.file.Close()
+			return nil, errors.Wrap(err, "failed syncing file")
+		}
+	}
+	err = w.file.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed closing file")
+	}
+	footer := w.footer
+	return &footer, nil
+}
+
+// Abort Close and remove a chunk that will not be completed.
+func (w *Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// Reader reads the rows of a chunk file and verifies them against the footer,
+// or against the index for a section.
+type Reader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	hash    hash.Hash32
+	err     error
+	footer  Footer
+	rows    uint64
+	done    bool
+	// section the rows read from a section of the chunk, nil if the whole chunk is read.
+	section *section
+}
+
+// section The rows of a chunk between start and end. The rows are read from the beginning of the index entry
+// holding start to the end of the one holding end, so every entry read is verified against its checksum.
+type section struct {
+	index      []IndexEntry
+	start, end int64
+	// offset position of the next row.
+	offset int64
+	// next index of the entry of the next checksum check.
+	next     int
+	checksum uint32
+	// pending rows were read since the last checksum check.
+	pending bool
+	framing framing.Framing
+	framed  []byte
+}
+
+// Open Open a chunk file and check its footer.
+// The row count and the checksum are verified while the rows are scanned:
+// Err reports a mismatch once the last row has been read.
+func Open(filename string) (*Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{file: f, hash: crc32.New(crcTable)}
+	err = r.readFooter()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "chunk %s", filename)
+	}
+	data := io.TeeReader(io.LimitReader(f, int64(r.footer.Size)), r.hash)
+	// a row is never longer than the rows of the chunk
+	r.scanner = framing.NewScanner(data, rowFraming(r.footer.Binary), int(r.footer.Size)+1)
+	return r, nil
+}
+
+// OpenSection Open a chunk file to read the rows between the offsets start and end.
+// The offsets must be the beginning of a row or the size of the rows. index is the index of the chunk
+// returned by ReadIndex: the rows of the entries holding the section are read and verified against it,
+// Err reports a mismatch.
+func OpenSection(filename string, index []IndexEntry, start, end int64) (*Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{file: f, hash: crc32.New(crcTable)}
+	err = r.readFooter()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "chunk %s", filename)
+	}
+	if start < 0 || start > end || end > int64(r.footer.Size) {
+		f.Close()
+		return nil, errors.Errorf("chunk %s: invalid section %d-%d", filename, start, end)
+	}
+	// the entry holding start and the first entry from end
+	first := sort.Search(len(index), func(i int) bool { return index[i].Offset > start }) - 1
+	last := sort.Search(len(index), func(i int) bool { return index[i].Offset >= end })
+	from, to := int64(0), int64(r.footer.Size)
+	if first >= 0 {
+		from = index[first].Offset
+	}
+	if last < len(index) {
+		to = index[last].Offset
+	}
+	if start == end {
+		from, to = start, start
+	}
+	r.section = &section{
+		index:   index,
+		start:   start,
+		end:     end,
+		offset:  from,
+		next:    first + 1,
+		framing: rowFraming(r.footer.Binary),
+	}
+	r.scanner = framing.NewScanner(io.NewSectionReader(f, from, to-from), r.section.framing, int(to-from)+1)
+	return r, nil
+}
+
+// ReadIndex Read the index of a chunk file.
+func ReadIndex(filename string) ([]IndexEntry, *Footer, error) {
+	r, err := Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	b := make([]byte, r.footer.IndexSize)
+	_, err = r.file.ReadAt(b, int64(r.footer.Size))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "chunk %s", filename)
+	}
+	if crc32.Checksum(b, crcTable) != r.footer.IndexChecksum {
+		return nil, nil, errors.Errorf("chunk %s: index checksum does not match footer", filename)
+	}
+	entries, err := unmarshalIndex(b)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "chunk %s", filename)
+	}
+	footer := r.Footer()
+	return entries, &footer, nil
+}
+
+// ReadFooter Read and check the footer of a chunk file without reading its rows.
+func ReadFooter(filename string) (*Footer, error) {
+	r, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	footer := r.Footer()
+	return &footer, nil
+}
+
+func (r *Reader) readFooter() error {
+	stat, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < FooterSize {
+		return errors.New("chunk is truncated")
+	}
+	b := make([]byte, FooterSize)
+	_, err = r.file.ReadAt(b, stat.Size()-FooterSize)
+	if err != nil {
+		return err
+	}
+	err = r.footer.unmarshal(b)
+	if err != nil {
+		return err
+	}
+	if r.footer.Size+r.footer.IndexSize != uint64(stat.Size()-FooterSize) {
+		return errors.Errorf("chunk size %d does not match footer size %d", stat.Size()-FooterSize, r.footer.Size+r.footer.IndexSize)
+	}
+	return nil
+}
+
+// Footer returns the footer of the chunk.
+func (r *Reader) Footer() Footer {
+	return r.footer
+}
+
+// Scan Advance to the next row. It returns false at the end of the chunk or on error.
+func (r *Reader) Scan() bool {
+	if r.err != nil || r.done {
+		return false
+	}
+	if r.section != nil {
+		return r.scanSection()
+	}
+	if r.scanner.Scan() {
+		r.rows++
+		return true
+	}
+	r.done = true
+	r.err = r.scanner.Err()
+	if r.err == nil {
+		r.err = r.verify()
+	}
+	return false
+}
+
+// scanSection Advance to the next row of the section, checking the checksum of every entry once read.
+func (r *Reader) scanSection() bool {
+	s := r.section
+	for {
+		if s.next < len(s.index) && s.offset == s.index[s.next].Offset {
+			r.err = r.verifyEntry()
+			if r.err != nil {
+				return false
+			}
+			s.next++
+		}
+		if !r.scanner.Scan() {
+			r.done = true
+			r.err = r.scanner.Err()
+			if r.err == nil {
+				r.err = r.verifyEntry()
+			}
+			return false
+		}
+		s.framed, r.err = s.framing.Append(s.framed[:0], r.scanner.Text())
+		if r.err != nil {
+			return false
+		}
+		s.checksum = crc32.Update(s.checksum, crcTable, s.framed)
+		s.pending = true
+		offset := s.offset
+		s.offset += int64(len(s.framed))
+		if offset >= s.start && offset < s.end {
+			r.rows++
+			return true
+		}
+	}
+}
+
+// verifyEntry Check the rows of the entry just read against its checksum, then reset the checksum.
+func (r *Reader) verifyEntry() error {
+	s := r.section
+	if !s.pending {
+		return nil
+	}
+	entry := s.index[s.next-1]
+	checksum := s.checksum
+	s.checksum, s.pending = 0, false
+	if checksum != entry.Checksum {
+		return errors.Errorf("chunk %s: checksum %08x of the rows at %d does not match index %08x", r.file.Name(), checksum, entry.Offset, entry.Checksum)
+	}
+	return nil
+}
+
+// Text returns the current row.
+func (r *Reader) Text() string {
+	return r.scanner.Text()
+}
+
+// Err returns the first error encountered while scanning.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Close Close the underlying file.
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+func (r *Reader) verify() error {
+	if r.rows != r.footer.Rows {
+		return errors.Errorf("chunk %s: read %d rows, footer expects %d", r.file.Name(), r.rows, r.footer.Rows)
+	}
+	if checksum := r.hash.Sum32(); checksum != r.footer.Checksum {
+		return errors.Errorf("chunk %s: checksum %08x does not match footer %08x", r.file.Name(), checksum, r.footer.Checksum)
+	}
+	return nil
+}
+
+// Verify Read a whole chunk file and check it against its footer.
+func Verify(filename string) (*Footer, error) {
+	r, err := Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for r.Scan() {
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	footer := r.Footer()
+	return &footer, nil
+}
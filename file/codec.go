@@ -0,0 +1,25 @@
+package file
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Codec Encode and decode a stream, e.g. to compress it.
+type Codec interface {
+	// NewReader returns a reader decoding r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer encoding to w. Closing it flushes the encoded stream but does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// GzipCodec Compress the stream with gzip.
+type GzipCodec struct{}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
@@ -0,0 +1,234 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/askiada/external-sort/vector/key"
+
+	"github.com/pkg/errors"
+)
+
+// Markers written before every row of a diff, followed by a tab.
+const (
+	// DiffOnlyA a row of A whose key is not in B.
+	DiffOnlyA = "-"
+	// DiffOnlyB a row of B whose key is not in A.
+	DiffOnlyB = "+"
+	// DiffChangedA a row of A changed in B, followed by the row of B.
+	DiffChangedA = "<"
+	// DiffChangedB a row of B replacing the row of A written before it.
+	DiffChangedB = ">"
+)
+
+// DiffSummary Number of rows of each kind found by a Differ.
+type DiffSummary struct {
+	OnlyA   int64 `json:"only_a"`
+	OnlyB   int64 `json:"only_b"`
+	Changed int64 `json:"changed"`
+	Same    int64 `json:"same"`
+}
+
+// Differ Compare two inputs by key. Both inputs are sorted by a Sorter, then read side by side.
+type Differ struct {
+	sorter *Sorter
+	keyA   func(line string) (key.Key, error)
+	keyB   func(line string) (key.Key, error)
+}
+
+// NewDiffer returns a Differ matching the rows of a and b with equal keys returned by keyA and keyB,
+// they must be comparable. The inputs are sorted with opts, WithKey is not used.
+func NewDiffer(keyA, keyB func(line string) (key.Key, error), opts ...Option) *Differ {
+	return &Differ{
+		sorter: NewSorter(opts...),
+		keyA:   keyA,
+		keyB:   keyB,
+	}
+}
+
+// lineKey A key followed by the whole row, so the rows of a key are sorted by their text.
+type lineKey struct {
+	key  key.Key
+	line string
+}
+
+func (k *lineKey) Less(other key.Key) bool {
+	o := other.(*lineKey)
+	if k.key.Less(o.key) {
+		return true
+	}
+	if o.key.Less(k.key) {
+		return false
+	}
+	return k.line < o.line
+}
+
+// allocateLineKey returns an allocator of the key of a row by allocateKey followed by the row.
+func allocateLineKey(allocateKey func(line string) (key.Key, error)) func(line string) (key.Key, error) {
+	return func(line string) (key.Key, error) {
+		k, err := allocateKey(line)
+		if err != nil {
+			return nil, err
+		}
+		return &lineKey{key: k, line: line}, nil
+	}
+}
+
+// Diff Write to out the rows of a and b that differ, in ascending order of keys, each one preceded by a marker.
+// Rows of a key found in both inputs are unchanged, the other ones of the key are paired as changed rows
+// and the rows left are only in a or only in b. Only the rows of a single key that differ are held in memory.
+// If out is an AtomicWriter, it is committed once all the rows are written and aborted if the diff fails.
+func (d *Differ) Diff(ctx context.Context, a, b io.Reader, out io.Writer) (summary DiffSummary, err error) {
+	fn := "diff"
+	output, err := newStreamOutput(out, d.sorter.outputCodec)
+	if err != nil {
+		if atomic, ok := out.(AtomicWriter); ok {
+			atomic.Abort()
+		}
+		return summary, errors.Wrap(err, fn)
+	}
+	sortedA, sortedB, stop := d.sorter.sortPair(ctx, a, b, allocateLineKey(d.keyA), allocateLineKey(d.keyB))
+	w := bufio.NewWriter(output)
+	frame := d.sorter.rowFraming()
+	err = d.merge(ctx, newSortedReader(sortedA, frame, d.sorter.maxRecordSize, d.keyA), newSortedReader(sortedB, frame, d.sorter.maxRecordSize, d.keyB), w, &summary)
+	if err == nil {
+		err = w.Flush()
+	}
+	err = stop(err)
+	if err != nil {
+		output.Abort()
+		return summary, errors.Wrap(err, fn)
+	}
+	return summary, errors.Wrap(output.Commit(), fn)
+}
+
+// merge Compare the rows of the sorted inputs key by key.
+func (d *Differ) merge(ctx context.Context, a, b *sortedReader, w *bufio.Writer, summary *DiffSummary) (err error) {
+	err = a.next()
+	if err != nil {
+		return err
+	}
+	err = b.next()
+	if err != nil {
+		return err
+	}
+	framed := []byte{}
+	write := func(marker, line string) error {
+		var err error
+		framed, err = d.sorter.rowFraming().Append(framed[:0], marker+"\t"+line)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(framed)
+		return err
+	}
+	for rows := 0; !a.done || !b.done; rows++ {
+		if rows%joinCheckRows == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch {
+		case b.done || (!a.done && a.key.Less(b.key)):
+			summary.OnlyA++
+			err = write(DiffOnlyA, a.line)
+			if err == nil {
+				err = a.next()
+			}
+		case a.done || b.key.Less(a.key):
+			summary.OnlyB++
+			err = write(DiffOnlyB, b.line)
+			if err == nil {
+				err = b.next()
+			}
+		default:
+			err = d.diffKey(a, b, write, summary)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffKey Compare the rows of the current key of both inputs, sorted by their text.
+// The rows found in a single input are kept in groups spilled to disk past the group limit.
+func (d *Differ) diffKey(a, b *sortedReader, write func(marker, line string) error, summary *DiffSummary) error {
+	k := a.key
+	newGroup := func() *joinGroup {
+		return &joinGroup{limit: d.sorter.groupLimit(), dir: d.sorter.tempDirs[0].Path, maxRecordSize: d.sorter.maxRecordSize}
+	}
+	onlyA, onlyB := newGroup(), newGroup()
+	defer onlyA.reset()
+	defer onlyB.reset()
+	for {
+		inA := !a.done && equalKeys(a.key, k)
+		inB := !b.done && equalKeys(b.key, k)
+		var err error
+		switch {
+		case inA && inB && a.line == b.line:
+			summary.Same++
+			err = a.next()
+			if err == nil {
+				err = b.next()
+			}
+		case inA && (!inB || a.line < b.line):
+			err = onlyA.add(a.line)
+			if err == nil {
+				err = a.next()
+			}
+		case inB:
+			err = onlyB.add(b.line)
+			if err == nil {
+				err = b.next()
+			}
+		default:
+			return d.writeKey(onlyA, onlyB, write, summary)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeKey Write the rows of a key found in a single input, paired as changed rows as long as possible.
+func (d *Differ) writeKey(onlyA, onlyB *joinGroup, write func(marker, line string) error, summary *DiffSummary) error {
+	rowsA, err := onlyA.read()
+	if err != nil {
+		return err
+	}
+	rowsB, err := onlyB.read()
+	if err != nil {
+		return err
+	}
+	nextA, nextB := rowsA.next(), rowsB.next()
+	for ; nextA && nextB; nextA, nextB = rowsA.next(), rowsB.next() {
+		summary.Changed++
+		err = write(DiffChangedA, rowsA.line)
+		if err != nil {
+			return err
+		}
+		err = write(DiffChangedB, rowsB.line)
+		if err != nil {
+			return err
+		}
+	}
+	for ; nextA; nextA = rowsA.next() {
+		summary.OnlyA++
+		err = write(DiffOnlyA, rowsA.line)
+		if err != nil {
+			return err
+		}
+	}
+	for ; nextB; nextB = rowsB.next() {
+		summary.OnlyB++
+		err = write(DiffOnlyB, rowsB.line)
+		if err != nil {
+			return err
+		}
+	}
+	err = rowsA.err()
+	if err != nil {
+		return err
+	}
+	return rowsB.err()
+}
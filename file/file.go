@@ -1,81 +1,332 @@
 package file
 
 import (
-	"bufio"
 	"context"
 	"sync"
 
 	"io"
+	"os"
 	"path"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/askiada/external-sort/file/batchingchannels"
+	"github.com/askiada/external-sort/file/chunkfile"
+	"github.com/askiada/external-sort/file/framing"
 	"github.com/askiada/external-sort/vector"
 
 	"github.com/pkg/errors"
 )
 
+// scanBlockSize number of lines handed over at once to the chunking workers.
+const scanBlockSize = 1024
+
+// newBlock returns an empty block starting at the line number line of the input source.
+func newBlock(source string, line int) batchingchannels.Block {
+	return batchingchannels.Block{
+		Lines:   make([]string, 0, scanBlockSize),
+		Offsets: make([]int64, 0, scanBlockSize),
+		Line:    line,
+		Source:  source,
+	}
+}
+
+// Info Settings and state of a sort run in two steps: CreateSortedChunks then MergeSort,
+// called on the same Info. Sorter runs both steps in a single call.
 type Info struct {
-	mu            *MemUsage
-	Reader        io.Reader
-	Allocate      *vector.Allocate
-	OutputPath    string
-	totalRows     int
+	mu *MemUsage
+	// Reader the rows to sort, only used if there is no Inputs.
+	Reader io.Reader
+	// Inputs sources of the rows to sort, read concurrently.
+	Inputs []Input
+	// SourceColumn add the name of the input to every row as a last tab separated column.
+	SourceColumn bool
+	Allocate     *vector.Allocate
+	// OpenOutput Create the destination for OutputPath. Defaults to CreateAtomicFile.
+	OpenOutput func(path string) (AtomicWriter, error)
+	OutputPath string
+	// Partitioning split the output in several files named after OutputPath. A single file is written if it is nil.
+	Partitioning *Partitioning
+	// GroupBy write a file per group of rows in the folder OutputPath, named after the group returned by GroupBy.
+	// Rows of a group must be consecutive in the output, e.g. the group is the key.
+	// The folder must be empty, GroupSuccessName is written in it once all the groups are complete.
+	// The files are written on the local disk, OpenOutput must be nil.
+	GroupBy func(line string) (string, error)
+	// GroupExtension extension of the files of the groups, e.g. .csv. Defaults to .tsv for rows delimited by lines,
+	// and to no extension for the other framings.
+	GroupExtension string
+	totalRows      int
+	// PrintMemUsage collect the peak memory usage, reported by Stats.
 	PrintMemUsage bool
+	// SyncChunks fsync every chunk file before closing it.
+	SyncChunks bool
+	// Resume keep the chunks when the merge fails, and skip the chunking phase
+	// when the chunks of the same input and settings are already on disk.
+	Resume bool
+	// InputPath path of the file behind Reader, used to identify the input when resuming.
+	InputPath string
+	// KeySpec describe the key used to sort, used to identify the sort when resuming.
+	KeySpec string
+	// Placement how the chunks are spread across the chunk folders.
+	Placement Placement
+	// ReadAhead read the next rows of every chunk in the background during the merge.
+	ReadAhead bool
+	// MemoryBudget maximum number of bytes of rows held in memory by the read-ahead. 0 means no limit.
+	MemoryBudget int64
+	// InMemorySize inputs of at most this many bytes are sorted in memory even when they hold more rows
+	// than a chunk. 0 only sorts in memory the inputs that fit in a single chunk.
+	InMemorySize int64
+	// MaxRecordSize maximum number of bytes of a row read from the inputs. 0 uses framing.DefaultMaxRecordSize.
+	MaxRecordSize int
+	// MergeWorkers number of key ranges merged in parallel, straight into the output file.
+	// 0 or 1 merges all the chunks at once, as does any sort whose ranges can not be written at a known offset
+	// or whose output, created by OpenOutput, is not an io.WriterAt.
+	MergeWorkers int
+	// CascadeFactor merge every CascadeFactor chunks into a larger run while the input is still read.
+	// 0 or 1 leaves all the chunks to MergeSort.
+	CascadeFactor int
+	// Stable keep the input order of the rows with equal keys.
+	Stable bool
+	job    *job
+	// Limit only write the first Limit rows. 0 writes all of them.
+	// If Limit rows fit in a chunk, they are selected while the input is scanned and no chunk is written.
+	Limit int
+	// RowPolicy what happens to the input rows whose key can not be allocated.
+	RowPolicy RowPolicy
+	// QuarantinePath file receiving the bad rows with QuarantineBadRows.
+	QuarantinePath string
+	// MaxErrors maximum number of bad rows skipped or quarantined before the sort fails. 0 means no limit.
+	MaxErrors int
+	badRows   *badRows
+	runStats  *stats
+	// Progress receive the progress of the sort. Nothing is reported if it is nil.
+	Progress ProgressReporter
+	// Metrics receive the measures of the sort while it runs. Nothing is measured if it is nil.
+	Metrics Metrics
+	// Framing how the rows of the input and the output are delimited, one row per line if it is nil.
+	// With any other framing, rows can contain newlines and the chunks store binary rows.
+	Framing framing.Framing
+	// Reduce collapse the rows with equal keys into a single row while they are merged, in the order of the input.
+	// It can not be used with Limit.
+	Reduce Reducer
+	// Combine also collapse the rows with equal keys of every chunk with Reduce before it is written.
+	Combine bool
+	// memory rows sorted in memory when the whole input fits in a single chunk.
+	memory vector.Vector
 }
 
 // CreateSortedChunks Scan a file and divide it into small sorted chunks.
-// Store all the chunks in a folder an returns all the paths.
-func (f *Info) CreateSortedChunks(ctx context.Context, chunkFolder string, dumpSize int, maxWorkers int64) ([]string, error) {
+// Store all the chunks in a new job folder inside each chunk folder and returns all the paths.
+// The job folders are removed if an error occurs, otherwise when MergeSort is done.
+// If the whole input fits in a single chunk, it is sorted in memory and no chunk is returned:
+// MergeSort then writes the rows directly to the output.
+func (f *Info) CreateSortedChunks(ctx context.Context, chunkDirs []ChunkDir, dumpSize int, maxWorkers int64) (chunkPaths []string, err error) {
 	fn := "scan and sort and dump"
 	if dumpSize <= 0 {
 		return nil, errors.Wrap(errors.New("dump size must be greater than 0"), fn)
 	}
+	if len(chunkDirs) == 0 {
+		return nil, errors.Wrap(errors.New("at least one chunk folder is required"), fn)
+	}
+	chunkFolders := make([]string, 0, len(chunkDirs))
+	for _, chunkDir := range chunkDirs {
+		chunkFolders = append(chunkFolders, chunkDir.Path)
+	}
 
-	if f.PrintMemUsage && f.mu == nil {
+	if f.collectsMemUsage() && f.mu == nil {
 		f.mu = &MemUsage{}
 	}
 
-	err := clearChunkFolder(chunkFolder)
+	err = f.Cleanup()
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	f.memory = nil
+	f.runStats = newStats(f.KeySpec)
+	if f.Reduce != nil && f.Limit > 0 {
+		return nil, errors.Wrap(errors.New("reduce can not be used with a limit"), fn)
+	}
+	if f.RowPolicy == QuarantineBadRows && f.QuarantinePath == "" {
+		return nil, errors.Wrap(errors.New("quarantine requires a quarantine path"), fn)
+	}
+	f.badRows = &badRows{policy: f.RowPolicy, maxErrors: f.MaxErrors, path: f.QuarantinePath, framing: f.framing()}
+	defer func() {
+		cerr := f.badRows.close()
+		if err == nil && cerr != nil {
+			err = errors.Wrap(cerr, fn)
+		}
+	}()
+	f.progress().Start(PhaseChunking, f.inputSize())
+	scanner := f.newInputs()
+	defer scanner.close()
+	if f.Limit > 0 && f.Limit <= dumpSize {
+		err = f.sortTopRows(scanner)
+		f.recordScan(scanner)
+		return nil, errors.Wrap(err, fn)
+	}
+	var prefetched *batchingchannels.Block
+	var inMemory bool
+	// when resuming, the input is only read if the chunks can not be resumed
+	if !f.Resume {
+		prefetched, inMemory, err = f.sortSmallInput(scanner, dumpSize)
+		if err != nil || inMemory {
+			f.recordScan(scanner)
+			return nil, errors.Wrap(err, fn)
+		}
+	}
+	var manifest *Manifest
+	if f.Resume {
+		manifest, err = f.newManifest(dumpSize, chunkFolders)
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		f.job, err = resumeJob(chunkFolders, manifest.jobName())
+	} else {
+		f.job, err = newJob(chunkFolders)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, fn)
 	}
-	row := 0
-	chunkPaths := []string{}
-	scanner := bufio.NewScanner(f.Reader)
+	defer func() {
+		if err != nil {
+			f.Cleanup()
+		}
+	}()
+	if manifest != nil {
+		chunkPaths, totalRows, ok := f.resumeChunks(manifest)
+		if ok {
+			f.totalRows = totalRows
+			for _, chunkPath := range chunkPaths {
+				info, err := os.Stat(chunkPath)
+				if err == nil {
+					f.addChunkBytes(info.Size())
+				}
+			}
+			f.progress().Finish(PhaseChunking)
+			return chunkPaths, nil
+		}
+		err = f.job.clear()
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		prefetched, inMemory, err = f.sortSmallInput(scanner, dumpSize)
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		if inMemory {
+			f.recordScan(scanner)
+			return nil, errors.Wrap(f.Cleanup(), fn)
+		}
+	}
 	mu := sync.Mutex{}
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	batchChan := batchingchannels.NewBatchingChannel(ctx, f.Allocate, maxWorkers, dumpSize)
 	go func() {
 		defer wg.Done()
-		for scanner.Scan() {
-			if f.PrintMemUsage {
-				f.mu.Collect()
+		defer batchChan.Close()
+		defer f.recordScan(scanner)
+		// nothing is scanned once the workers stopped
+		send := func(b batchingchannels.Block) bool {
+			select {
+			case batchChan.In() <- b:
+				return true
+			case <-batchChan.Done():
+				return false
 			}
-			text := scanner.Text()
-			batchChan.In() <- text
-			row++
 		}
-		batchChan.Close()
+		if !send(*prefetched) {
+			return
+		}
+		// lines are handed over in blocks, their keys are allocated by the workers
+		scanner.read(send)
 	}()
 
-	chunkIdx := 0
-	err = batchChan.ProcessOut(func(v vector.Vector) error {
-		mu.Lock()
-		chunkIdx++
-		chunkPath := path.Join(chunkFolder, "chunk_"+strconv.Itoa(chunkIdx)+".tsv")
-		mu.Unlock()
-		v.Sort()
-		err := vector.Dump(v, chunkPath)
+	placer := newPlacer(chunkDirs, f.Placement)
+	runs := []run{}
+	var c *cascade
+	if f.CascadeFactor > 1 {
+		// a cascade merge holds about as many rows as a chunk
+		k := dumpSize / f.CascadeFactor
+		if k < 1 {
+			k = 1
+		}
+		c = f.newCascade(ctx, placer, f.CascadeFactor, k)
+	}
+	err = batchChan.ProcessBlocks(func(b batchingchannels.Block) error {
+		v := f.Allocate.Vector(len(b.Lines), f.Allocate.Key)
+		err := f.allocateRows(v, b)
 		if err != nil {
 			return err
 		}
+		if v.Len() == 0 {
+			// the cascade still needs the position of the batch
+			if c != nil {
+				c.add <- run{seq: b.Seq}
+			}
+			return nil
+		}
+		start := time.Now()
+		if f.stable() {
+			v.SortStable()
+		} else {
+			v.Sort()
+		}
+		if f.Reduce != nil && f.Combine {
+			v, err = f.combine(v)
+			if err != nil {
+				return err
+			}
+		}
+		// rows after the first Limit rows of a chunk can not be part of the output
+		if f.Limit > 0 {
+			v.Truncate(f.Limit)
+		}
+		dirIdx, err := placer.reserve(chunkSize(v, f.binaryChunks()))
+		if err != nil {
+			return err
+		}
+		// chunks are numbered in the order of the input
+		chunkPath := path.Join(f.job.dirs[dirIdx], "chunk_"+strconv.Itoa(b.Seq+1)+".tsv")
+		sorted := time.Now()
+		w, err := f.createChunk(chunkPath)
+		if err != nil {
+			return err
+		}
+		footer, err := dumpChunk(v, w)
+		if err != nil {
+			return err
+		}
+		r := run{path: chunkPath, dir: dirIdx, footer: footer, seq: b.Seq}
+		f.runStats.update(func(report *Stats) {
+			report.Durations.Sort += sorted.Sub(start).Seconds()
+			report.Durations.Dump += time.Since(sorted).Seconds()
+		})
+		f.runStats.addChunk(r.size())
+		f.metrics().AddChunksWritten(1)
+		f.addChunkBytes(r.size())
+		if c != nil {
+			c.add <- r
+			return nil
+		}
 		mu.Lock()
-		chunkPaths = append(chunkPaths, chunkPath)
+		runs = append(runs, r)
 		mu.Unlock()
 		return nil
 	})
+	if c != nil {
+		merged, cerr := c.close()
+		if err == nil {
+			err = cerr
+		}
+		runs = merged
+	} else {
+		// rows with equal keys are merged in the order of the chunks
+		sort.Slice(runs, func(i, j int) bool {
+			return runs[i].seq < runs[j].seq
+		})
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, fn)
 	}
@@ -83,6 +334,104 @@ func (f *Info) CreateSortedChunks(ctx context.Context, chunkFolder string, dumpS
 	if scanner.Err() != nil {
 		return nil, errors.Wrap(scanner.Err(), fn)
 	}
-	f.totalRows = row
+	rows, _ := scanner.totals()
+	f.totalRows = rows - f.BadRows()
+	chunkPaths = make([]string, 0, len(runs))
+	for _, r := range runs {
+		chunkPaths = append(chunkPaths, r.path)
+		if manifest != nil {
+			manifest.addChunk(r.dir, r.path, r.footer)
+		}
+	}
+	if manifest != nil {
+		manifest.TotalRows = f.totalRows
+		err = manifest.write(f.job.dirs[0])
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+	}
 	return chunkPaths, nil
 }
+
+// recordScan Add the rows and bytes read from the inputs to the report, and finish the chunking phase.
+func (f *Info) recordScan(scanner *inputs) {
+	scanner.close()
+	rows, bytes := scanner.totals()
+	f.progress().Finish(PhaseChunking)
+	f.runStats.update(func(report *Stats) {
+		report.RowsRead = int64(rows)
+		report.BytesRead = bytes
+		report.Durations.Scan = time.Since(f.runStats.started).Seconds()
+	})
+}
+
+// resumeChunks Load the chunks left by a previous run of the same sort.
+// It returns false if there is no complete and valid set of chunks to resume from.
+func (f *Info) resumeChunks(manifest *Manifest) ([]string, int, bool) {
+	previous, err := readManifest(f.job.dirs[0])
+	if err != nil || !previous.matches(manifest) {
+		return nil, 0, false
+	}
+	chunkPaths, err := previous.verify(f.job.dirs)
+	if err != nil {
+		return nil, 0, false
+	}
+	return chunkPaths, previous.TotalRows, true
+}
+
+// Cleanup Remove the job folder created by CreateSortedChunks and all the chunks left in it.
+// MergeSort calls it once done, it is only needed when MergeSort is not called.
+func (f *Info) Cleanup() error {
+	if f.job == nil {
+		return nil
+	}
+	err := f.job.remove()
+	f.job = nil
+	f.clearChunkBytes()
+	return err
+}
+
+// release Unlock the job folder but keep it on disk if it can be resumed, otherwise remove it.
+func (f *Info) release() error {
+	if f.job == nil || !f.job.resumable {
+		return f.Cleanup()
+	}
+	err := f.job.release()
+	f.job = nil
+	f.clearChunkBytes()
+	return err
+}
+
+// framing returns how the rows of the input and the output are delimited.
+func (f *Info) framing() framing.Framing {
+	if f.Framing == nil {
+		return framing.Newline
+	}
+	return f.Framing
+}
+
+// stable returns true if the rows with equal keys keep the input order.
+// They always do with Reduce, so First and Last are the first and last rows of the input.
+func (f *Info) stable() bool {
+	return f.Stable || f.Reduce != nil
+}
+
+// binaryChunks returns true if the rows can contain newlines, so they are stored in binary chunks.
+func (f *Info) binaryChunks() bool {
+	return f.framing() != framing.Newline
+}
+
+// chunkSize returns the size in bytes of the chunk file written by dumpChunk, binary if binary is set.
+func chunkSize(v vector.Vector, binary bool) int64 {
+	size := int64(chunkfile.FooterSize)
+	offset := int64(0)
+	for i := 0; i < v.Len(); i++ {
+		line := v.Get(i).Line
+		if i%chunkfile.IndexInterval == 0 {
+			size += chunkfile.IndexEntrySize(line, offset)
+		}
+		offset += chunkfile.RowSize(line, binary)
+	}
+	size += offset
+	return size
+}
@@ -0,0 +1,202 @@
+// Package framing delimits the records of a stream.
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Framing How records are delimited in a stream.
+type Framing interface {
+	// Split is a bufio.SplitFunc returning one record per token.
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+	// Append returns dst with the framed record appended, or an error if the record can not be framed.
+	Append(dst []byte, record string) ([]byte, error)
+	// Size returns the number of bytes of the framed record.
+	Size(record string) int64
+	// String returns the name of the framing, as parsed by Parse.
+	String() string
+}
+
+var (
+	// Newline one record per line. The last line feed is optional and a carriage return before it is dropped.
+	Newline Framing = newline{}
+	// NUL every record is terminated by a NUL byte, like sort -z. The last terminator is optional.
+	NUL Framing = nul{}
+	// LengthPrefixed every record is preceded by its length as a uvarint. Records can contain any byte.
+	LengthPrefixed Framing = lengthPrefixed{}
+)
+
+// Parse returns the framing named name: newline, nul, length or fixed:N for records of N bytes.
+func Parse(name string) (Framing, error) {
+	switch name {
+	case "", "newline":
+		return Newline, nil
+	case "nul":
+		return NUL, nil
+	case "length":
+		return LengthPrefixed, nil
+	}
+	if strings.HasPrefix(name, "fixed:") {
+		width, err := strconv.Atoi(strings.TrimPrefix(name, "fixed:"))
+		if err != nil || width <= 0 {
+			return nil, errors.Errorf("invalid record width in framing %s", name)
+		}
+		return FixedWidth(width), nil
+	}
+	return nil, errors.Errorf("unknown framing %s", name)
+}
+
+// DefaultMaxRecordSize maximum number of bytes of a record read by NewScanner when none is set.
+const DefaultMaxRecordSize = 64 << 20
+
+var (
+	// ErrTruncated the stream ends in the middle of a record.
+	ErrTruncated = errors.New("truncated record")
+	// ErrTooLong the record is longer than the width of a fixed width framing.
+	ErrTooLong = errors.New("record longer than the width")
+)
+
+// NewScanner returns a scanner of the records of r delimited by frame.
+// Records can be up to maxRecordSize bytes, DefaultMaxRecordSize if it is 0 or less.
+func NewScanner(r io.Reader, frame Framing, maxRecordSize int) *bufio.Scanner {
+	if maxRecordSize <= 0 {
+		maxRecordSize = DefaultMaxRecordSize
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(frame.Split)
+	// the buffer also holds the length or the delimiter of the record
+	scanner.Buffer(nil, maxRecordSize+binary.MaxVarintLen64+1)
+	return scanner
+}
+
+type newline struct{}
+
+func (newline) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return bufio.ScanLines(data, atEOF)
+}
+
+func (newline) Append(dst []byte, record string) ([]byte, error) {
+	dst = append(dst, record...)
+	return append(dst, '\n'), nil
+}
+
+func (newline) Size(record string) int64 {
+	return int64(len(record)) + 1
+}
+
+func (newline) String() string {
+	return "newline"
+}
+
+type nul struct{}
+
+func (nul) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	// request more data
+	return 0, nil, nil
+}
+
+func (nul) Append(dst []byte, record string) ([]byte, error) {
+	dst = append(dst, record...)
+	return append(dst, 0), nil
+}
+
+func (nul) Size(record string) int64 {
+	return int64(len(record)) + 1
+}
+
+func (nul) String() string {
+	return "nul"
+}
+
+// FixedWidth returns a framing of records of width bytes, without any delimiter.
+// Shorter records are padded with spaces when written, longer ones are an ErrTooLong error.
+func FixedWidth(width int) Framing {
+	return fixedWidth(width)
+}
+
+type fixedWidth int
+
+func (w fixedWidth) Split(data []byte, atEOF bool) (int, []byte, error) {
+	width := int(w)
+	if len(data) >= width {
+		return width, data[:width], nil
+	}
+	if atEOF && len(data) > 0 {
+		return 0, nil, ErrTruncated
+	}
+	// request more data
+	return 0, nil, nil
+}
+
+func (w fixedWidth) Append(dst []byte, record string) ([]byte, error) {
+	width := int(w)
+	if len(record) > width {
+		return dst, errors.Wrapf(ErrTooLong, "%d bytes in %s", len(record), w.String())
+	}
+	dst = append(dst, record...)
+	for i := len(record); i < width; i++ {
+		dst = append(dst, ' ')
+	}
+	return dst, nil
+}
+
+func (w fixedWidth) Size(record string) int64 {
+	return int64(w)
+}
+
+func (w fixedWidth) String() string {
+	return "fixed:" + strconv.Itoa(int(w))
+}
+
+type lengthPrefixed struct{}
+
+func (lengthPrefixed) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	length, n := binary.Uvarint(data)
+	if n < 0 {
+		return 0, nil, errors.New("invalid record length")
+	}
+	if n == 0 || uint64(len(data)-n) < length {
+		if atEOF {
+			return 0, nil, ErrTruncated
+		}
+		// request more data
+		return 0, nil, nil
+	}
+	end := n + int(length)
+	return end, data[n:end], nil
+}
+
+func (lengthPrefixed) Append(dst []byte, record string) ([]byte, error) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(record)))
+	dst = append(dst, tmp[:n]...)
+	return append(dst, record...), nil
+}
+
+func (lengthPrefixed) Size(record string) int64 {
+	var tmp [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(tmp[:], uint64(len(record))) + len(record))
+}
+
+func (lengthPrefixed) String() string {
+	return "length"
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package file
+
+import "math"
+
+// freeSpace returns an unlimited space as the free space of a disk is not known on this platform.
+func freeSpace(dir string) (int64, error) {
+	return math.MaxInt64, nil
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package file
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users on the disk of dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,197 @@
+package file
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/vector"
+
+	"github.com/pkg/errors"
+)
+
+// GroupPath returns the path of the file of a group in the folder outputDir, e.g. out/<group>.tsv for the extension .tsv.
+// The group is escaped so it is a valid file name that can not be the name of another group.
+func GroupPath(outputDir, group, ext string) string {
+	name := url.PathEscape(group)
+	switch {
+	case name == "":
+		name = "_empty"
+	// names starting with _ are left to the empty group and GroupSuccessName
+	case strings.HasPrefix(name, "_"):
+		name = "%5F" + name[1:]
+	// hidden files are used for the outputs not yet committed
+	case strings.HasPrefix(name, "."):
+		name = "%2E" + name[1:]
+	}
+	return path.Join(outputDir, name+ext)
+}
+
+// GroupSuccessName name of the file written in the output folder once all the groups are published.
+const GroupSuccessName = "_SUCCESS"
+
+// groupPath returns the path of the file of group in OutputPath.
+// Its extension is GroupExtension, .tsv for rows delimited by lines and none for the other framings by default.
+func (f *Info) groupPath(group string) string {
+	ext := f.GroupExtension
+	if ext == "" && f.framing() == framing.Newline {
+		ext = ".tsv"
+	}
+	return GroupPath(f.OutputPath, group, ext)
+}
+
+// groupWriter Write the merged rows in a file per group. Rows are sorted by group,
+// so a single file is open at a time: it is renamed to its final path as soon as the next group starts.
+// The folder is synced once, after the last group, and GroupSuccessName is written last.
+type groupWriter struct {
+	f       *Info
+	current *os.File
+	w       *bufio.Writer
+	group   string
+	framed  []byte
+}
+
+// newGroupWriter Create the folder OutputPath receiving the files of the groups. The folder must be empty.
+// The files are written on the local disk, OpenOutput can not create them.
+func (f *Info) newGroupWriter() (*groupWriter, error) {
+	if f.Partitioning != nil {
+		return nil, errors.New("the output can not be both partitioned and grouped")
+	}
+	if f.OpenOutput != nil {
+		return nil, errors.New("the groups are written to local files, they can not be created by OpenOutput")
+	}
+	err := os.MkdirAll(f.OutputPath, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(f.OutputPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, errors.Errorf("output folder %s is not empty", f.OutputPath)
+	}
+	return &groupWriter{f: f}, nil
+}
+
+// open Publish the file of the current group and start the file of group.
+// The folder was empty, so an existing file means the group was already written.
+func (gw *groupWriter) open(group string) error {
+	err := gw.commitCurrent()
+	if err != nil {
+		return err
+	}
+	groupPath := gw.f.groupPath(group)
+	_, err = os.Lstat(groupPath)
+	if err == nil {
+		return errors.Errorf("rows of group %q are not consecutive, the output must be sorted by group", group)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	gw.current, err = os.CreateTemp(gw.f.OutputPath, "."+path.Base(groupPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = gw.current.Chmod(0o644)
+	if err != nil {
+		gw.Abort()
+		return err
+	}
+	gw.w = bufio.NewWriter(gw.current)
+	gw.group = group
+	return nil
+}
+
+// commitCurrent Flush the file of the current group and rename it to its final path.
+func (gw *groupWriter) commitCurrent() error {
+	if gw.current == nil {
+		return nil
+	}
+	err := gw.w.Flush()
+	if err == nil {
+		err = gw.current.Close()
+	}
+	if err == nil {
+		err = os.Rename(gw.current.Name(), gw.f.groupPath(gw.group))
+	}
+	if err != nil {
+		gw.Abort()
+		return err
+	}
+	gw.current = nil
+	return nil
+}
+func (gw *groupWriter) writeRows(rows vector.Vector) error {
+	n := int64(rows.Len())
+	gw.f.runStats.update(func(report *Stats) {
+		report.RowsWritten += n
+	})
+	gw.f.metrics().AddMergeRows(n)
+	for i := 0; i < rows.Len(); i++ {
+		line := rows.Get(i).Line
+		group, err := gw.f.GroupBy(line)
+		if err != nil {
+			return err
+		}
+		if gw.current == nil || group != gw.group {
+			err = gw.open(group)
+			if err != nil {
+				return err
+			}
+		}
+		gw.framed, err = gw.f.framing().Append(gw.framed[:0], line)
+		if err != nil {
+			return err
+		}
+		_, err = gw.w.Write(gw.framed)
+		if err != nil {
+			return err
+		}
+	}
+	rows.Reset()
+	return nil
+}
+
+func (gw *groupWriter) flush() error {
+	if gw.current == nil {
+		return nil
+	}
+	return gw.w.Flush()
+}
+
+// Commit Publish the file of the last group, sync the folder and write GroupSuccessName.
+func (gw *groupWriter) Commit() error {
+	fn := "commit groups"
+	err := gw.commitCurrent()
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	err = syncDir(gw.f.OutputPath)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	marker, err := CreateAtomicFile(path.Join(gw.f.OutputPath, GroupSuccessName))
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	return errors.Wrap(marker.Commit(), fn)
+}
+
+// Abort Discard the file of the current group. The files of the groups already complete are kept,
+// without GroupSuccessName.
+func (gw *groupWriter) Abort() error {
+	if gw.current == nil {
+		return nil
+	}
+	gw.current.Close()
+	err := os.Remove(gw.current.Name())
+	gw.current = nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package file
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/askiada/external-sort/file/batchingchannels"
+
+	"github.com/pkg/errors"
+)
+
+// readParallelism maximum number of inputs read at the same time.
+const readParallelism = 16
+
+// Input A source of rows of a sort.
+type Input struct {
+	// Name identify the input in the errors and in the source column.
+	Name string
+	// Size number of bytes of the input, 0 if it is unknown.
+	Size int64
+	// Open returns the content of the input. It is called once, when the input is read.
+	Open func() (io.ReadCloser, error)
+}
+
+// FileInputs returns an input for every local file matching the patterns, in order.
+// A pattern matching no file is an error.
+func FileInputs(patterns ...string) ([]Input, error) {
+	fn := "file inputs"
+	inputs := []Input{}
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		if len(paths) == 0 {
+			return nil, errors.Wrapf(os.ErrNotExist, "%s: %s", fn, pattern)
+		}
+		for _, p := range paths {
+			stat, err := os.Stat(p)
+			if err != nil {
+				return nil, errors.Wrap(err, fn)
+			}
+			p := p
+			inputs = append(inputs, Input{
+				Name: p,
+				Size: stat.Size(),
+				Open: func() (io.ReadCloser, error) {
+					return os.Open(p)
+				},
+			})
+		}
+	}
+	return inputs, nil
+}
+
+// inputs Scan the inputs of a sort. They are read one after the other by Scan,
+// then the inputs left are read concurrently by read.
+type inputs struct {
+	f       *Info
+	pending []Input
+	current *lineScanner
+	// mu protects the scanners and the first error of the concurrent reads.
+	mu       sync.Mutex
+	scanners []*lineScanner
+	err      error
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newInputs returns the inputs of the sort, or Reader if there is none.
+func (f *Info) newInputs() *inputs {
+	pending := f.Inputs
+	if len(pending) == 0 {
+		pending = []Input{{
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(f.Reader), nil
+			},
+		}}
+	}
+	return &inputs{f: f, pending: pending, stop: make(chan struct{})}
+}
+
+// open Open an input and return its scanner.
+func (in *inputs) open(input Input) (*lineScanner, error) {
+	r, err := input.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "input %s", input.Name)
+	}
+	s := newLineScanner(r, in.f.framing(), in.f.MaxRecordSize, in.f.progress(), in.f.metrics())
+	s.source = input.Name
+	s.closer = r
+	if in.f.SourceColumn {
+		s.suffix = "\t" + input.Name
+	}
+	in.mu.Lock()
+	in.scanners = append(in.scanners, s)
+	in.mu.Unlock()
+	return s, nil
+}
+
+// fail Record the first error and stop the concurrent reads.
+func (in *inputs) fail(err error) {
+	in.mu.Lock()
+	if in.err == nil {
+		in.err = err
+	}
+	in.mu.Unlock()
+	in.halt()
+}
+
+// halt Stop the concurrent reads.
+func (in *inputs) halt() {
+	in.stopOnce.Do(func() {
+		close(in.stop)
+	})
+}
+
+// Err returns the first error encountered while reading the inputs.
+func (in *inputs) Err() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.err
+}
+
+// Scan Advance to the next row, reading the inputs one after the other.
+func (in *inputs) Scan() bool {
+	for {
+		if in.current != nil {
+			if in.current.Scan() {
+				return true
+			}
+			err := in.current.close()
+			in.current = nil
+			if err != nil {
+				in.fail(err)
+				return false
+			}
+		}
+		if len(in.pending) == 0 || in.Err() != nil {
+			return false
+		}
+		s, err := in.open(in.pending[0])
+		in.pending = in.pending[1:]
+		if err != nil {
+			in.fail(err)
+			return false
+		}
+		in.current = s
+	}
+}
+
+// Text returns the current row.
+func (in *inputs) Text() string {
+	return in.current.Text()
+}
+
+// position returns the input, the line number and the offset of the current row.
+func (in *inputs) position() (string, int, int64) {
+	return in.current.source, in.current.line, in.current.offset
+}
+
+// read Read the rest of the inputs concurrently and hand their rows over in blocks to send.
+// Every input stops once send returns false.
+func (in *inputs) read(send func(batchingchannels.Block) bool) {
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, readParallelism)
+	scan := func(s *lineScanner) {
+		block := newBlock(s.source, s.line+1)
+		for s.Scan() {
+			in.f.collectMemUsage()
+			block.Lines = append(block.Lines, s.Text())
+			block.Offsets = append(block.Offsets, s.offset)
+			if len(block.Lines) == scanBlockSize {
+				if !send(block) {
+					in.halt()
+					return
+				}
+				block = newBlock(s.source, s.line+1)
+			}
+		}
+		if len(block.Lines) > 0 && !send(block) {
+			in.halt()
+		}
+	}
+	start := func(open func() (*lineScanner, error)) bool {
+		select {
+		case sem <- struct{}{}:
+		case <-in.stop:
+			return false
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s, err := open()
+			if err != nil {
+				in.fail(err)
+				return
+			}
+			scan(s)
+			err = s.close()
+			if err != nil {
+				in.fail(err)
+			}
+		}()
+		return true
+	}
+	if in.current != nil {
+		current := in.current
+		in.current = nil
+		if !start(func() (*lineScanner, error) { return current, nil }) {
+			current.close()
+		}
+	}
+	for len(in.pending) > 0 {
+		input := in.pending[0]
+		in.pending = in.pending[1:]
+		ok := start(func() (*lineScanner, error) { return in.open(input) })
+		if !ok {
+			break
+		}
+	}
+	wg.Wait()
+}
+
+// totals returns the number of rows and bytes read from all the inputs.
+func (in *inputs) totals() (int, int64) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	rows, bytes := 0, int64(0)
+	for _, s := range in.scanners {
+		rows += s.line
+		bytes += s.next
+	}
+	return rows, bytes
+}
+
+// close Close the input still open after an early stop.
+func (in *inputs) close() {
+	if in.current != nil {
+		in.current.close()
+		in.current = nil
+	}
+}
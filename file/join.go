@@ -0,0 +1,325 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/vector/key"
+
+	"github.com/pkg/errors"
+)
+
+// JoinType Which rows without a match on the other side are written by a Joiner.
+type JoinType int
+
+const (
+	// InnerJoin only write the rows with a match.
+	InnerJoin JoinType = iota
+	// LeftJoin also write the left rows without a match.
+	LeftJoin
+	// RightJoin also write the right rows without a match.
+	RightJoin
+	// FullJoin also write the rows without a match of both sides.
+	FullJoin
+)
+
+const (
+	// defaultGroupRows number of rows with the same key held in memory when neither Join.GroupRows
+	// nor WithGroupRows is set.
+	defaultGroupRows = 1 << 16
+	// joinCheckRows number of rows joined between two checks of the context.
+	joinCheckRows = 1024
+)
+
+// JoinColumn A column of the joined rows, taken from the left or the right row.
+type JoinColumn struct {
+	// Right take the column from the right row instead of the left one.
+	Right bool
+	// Column position of the tab separated column, starting at 0.
+	Column int
+}
+
+// Join Settings of a join.
+type Join struct {
+	Type JoinType
+	// LeftKey and RightKey return the keys of the rows of each side, they must be comparable.
+	LeftKey  func(line string) (key.Key, error)
+	RightKey func(line string) (key.Key, error)
+	// Columns of the joined rows, empty when the row is missing or too short.
+	// The whole left row and the whole right row separated by a tab are written if it is nil.
+	Columns []JoinColumn
+	// GroupRows maximum number of right rows with the same key held in memory, the others are spilled to disk.
+	GroupRows int
+}
+
+// Joiner Join two inputs on their keys. Both inputs are sorted by a Sorter,
+// then read side by side so the rows with equal keys are joined while they are streamed.
+type Joiner struct {
+	sorter *Sorter
+	join   Join
+}
+
+// NewJoiner returns a Joiner with the settings of join, the inputs are sorted with opts.
+// WithKey is not used.
+func NewJoiner(join Join, opts ...Option) *Joiner {
+	sorter := NewSorter(opts...)
+	if join.GroupRows <= 0 {
+		join.GroupRows = sorter.groupLimit()
+	}
+	return &Joiner{
+		sorter: sorter,
+		join:   join,
+	}
+}
+
+// Join Write to out the joined rows of left and right, in ascending order of keys.
+// If out is an AtomicWriter, it is committed once all the rows are written and aborted if the join fails.
+func (j *Joiner) Join(ctx context.Context, left, right io.Reader, out io.Writer) (err error) {
+	fn := "join"
+	output, err := newStreamOutput(out, j.sorter.outputCodec)
+	if err != nil {
+		if atomic, ok := out.(AtomicWriter); ok {
+			atomic.Abort()
+		}
+		return errors.Wrap(err, fn)
+	}
+	leftSorted, rightSorted, stop := j.sorter.sortPair(ctx, left, right, j.join.LeftKey, j.join.RightKey)
+	w := bufio.NewWriter(output)
+	frame := j.sorter.rowFraming()
+	err = j.merge(ctx, newSortedReader(leftSorted, frame, j.sorter.maxRecordSize, j.join.LeftKey), newSortedReader(rightSorted, frame, j.sorter.maxRecordSize, j.join.RightKey), w)
+	if err == nil {
+		err = w.Flush()
+	}
+	err = stop(err)
+	if err != nil {
+		output.Abort()
+		return errors.Wrap(err, fn)
+	}
+	return errors.Wrap(output.Commit(), fn)
+}
+
+// merge Join the rows of the sorted sides. The right rows of every key are kept in a group
+// while all the left rows of the same key are joined with them.
+func (j *Joiner) merge(ctx context.Context, left, right *sortedReader, w *bufio.Writer) (err error) {
+	group := &joinGroup{limit: j.join.GroupRows, dir: j.sorter.tempDirs[0].Path, maxRecordSize: j.sorter.maxRecordSize}
+	defer group.reset()
+	err = left.next()
+	if err != nil {
+		return err
+	}
+	err = right.next()
+	if err != nil {
+		return err
+	}
+	framed := []byte{}
+	write := func(l, r *string) error {
+		var err error
+		framed, err = j.sorter.rowFraming().Append(framed[:0], j.joined(l, r))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(framed)
+		return err
+	}
+	for rows := 0; !left.done || !right.done; rows++ {
+		if rows%joinCheckRows == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch {
+		case right.done || (!left.done && left.key.Less(right.key)):
+			if j.join.Type == LeftJoin || j.join.Type == FullJoin {
+				err = write(&left.line, nil)
+				if err != nil {
+					return err
+				}
+			}
+			err = left.next()
+		case left.done || right.key.Less(left.key):
+			if j.join.Type == RightJoin || j.join.Type == FullJoin {
+				err = write(nil, &right.line)
+				if err != nil {
+					return err
+				}
+			}
+			err = right.next()
+		default:
+			err = j.joinGroup(left, right, group, write)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinGroup Join all the left rows and all the right rows of the current key.
+func (j *Joiner) joinGroup(left, right *sortedReader, group *joinGroup, write func(l, r *string) error) error {
+	k := right.key
+	defer group.reset()
+	// the sides are sorted, so the following rows have a key greater than or equal to k
+	for !right.done && !k.Less(right.key) {
+		err := group.add(right.line)
+		if err != nil {
+			return err
+		}
+		err = right.next()
+		if err != nil {
+			return err
+		}
+	}
+	for !left.done && !k.Less(left.key) {
+		err := group.each(func(r string) error {
+			return write(&left.line, &r)
+		})
+		if err != nil {
+			return err
+		}
+		err = left.next()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joined returns the joined row of the left and the right rows, nil if there is no row on a side.
+func (j *Joiner) joined(l, r *string) string {
+	if j.join.Columns == nil {
+		left, right := "", ""
+		if l != nil {
+			left = *l
+		}
+		if r != nil {
+			right = *r
+		}
+		return left + "\t" + right
+	}
+	var leftColumns, rightColumns []string
+	if l != nil {
+		leftColumns = strings.Split(*l, "\t")
+	}
+	if r != nil {
+		rightColumns = strings.Split(*r, "\t")
+	}
+	columns := make([]string, len(j.join.Columns))
+	for i, c := range j.join.Columns {
+		row := leftColumns
+		if c.Right {
+			row = rightColumns
+		}
+		if c.Column < len(row) {
+			columns[i] = row[c.Column]
+		}
+	}
+	return strings.Join(columns, "\t")
+}
+
+// joinGroup The rows of a key, the right rows of a join or the rows of an input changed by a diff.
+// Rows after the first limit ones are spilled to a temporary file, so a huge group does not have to fit in memory.
+type joinGroup struct {
+	rows          []string
+	limit         int
+	dir           string
+	maxRecordSize int
+	spill         *os.File
+	w             *bufio.Writer
+	framed        []byte
+}
+
+// add Add a row to the group.
+func (g *joinGroup) add(line string) error {
+	if g.spill == nil && len(g.rows) < g.limit {
+		g.rows = append(g.rows, line)
+		return nil
+	}
+	if g.spill == nil {
+		var err error
+		g.spill, err = os.CreateTemp(g.dir, "group-*")
+		if err != nil {
+			return err
+		}
+		g.w = bufio.NewWriter(g.spill)
+	}
+	// spilled rows can contain any byte
+	var err error
+	g.framed, err = framing.LengthPrefixed.Append(g.framed[:0], line)
+	if err != nil {
+		return err
+	}
+	_, err = g.w.Write(g.framed)
+	return err
+}
+
+// each Call fn with every row of the group, in order.
+func (g *joinGroup) each(fn func(line string) error) error {
+	r, err := g.read()
+	if err != nil {
+		return err
+	}
+	for r.next() {
+		err = fn(r.line)
+		if err != nil {
+			return err
+		}
+	}
+	return r.err()
+}
+
+// read returns a reader of the rows of the group from the first one.
+// The group must not change while the rows are read.
+func (g *joinGroup) read() (*groupReader, error) {
+	r := &groupReader{rows: g.rows}
+	if g.spill == nil {
+		return r, nil
+	}
+	err := g.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	_, err = g.spill.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	r.scanner = framing.NewScanner(g.spill, framing.LengthPrefixed, g.maxRecordSize)
+	return r, nil
+}
+
+// groupReader Read the rows held in memory by a group, then the spilled ones.
+type groupReader struct {
+	rows    []string
+	scanner *bufio.Scanner
+	line    string
+}
+
+// next Advance to the next row, it returns false once all the rows are read or if the read failed.
+func (r *groupReader) next() bool {
+	if len(r.rows) > 0 {
+		r.line = r.rows[0]
+		r.rows = r.rows[1:]
+		return true
+	}
+	if r.scanner == nil || !r.scanner.Scan() {
+		return false
+	}
+	r.line = r.scanner.Text()
+	return true
+}
+
+// err returns the error of the read of the spilled rows, if any.
+func (r *groupReader) err() error {
+	if r.scanner == nil {
+		return nil
+	}
+	return r.scanner.Err()
+}
+
+// reset Empty the group and remove its spilled rows.
+func (g *joinGroup) reset() {
+	g.rows = g.rows[:0]
+	removeTemp(g.spill)
+	g.spill = nil
+}
@@ -0,0 +1,81 @@
+package file
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/askiada/external-sort/file/batchingchannels"
+	"github.com/askiada/external-sort/vector"
+)
+
+// topRow A row kept by topRows and its position in the input.
+type topRow struct {
+	elem *vector.Element
+	seq  int
+}
+
+// after returns whether a comes after b in the output.
+// Rows with equal keys are ordered by their position in the input.
+func (a *topRow) after(b *topRow) bool {
+	if vector.Less(b.elem, a.elem) {
+		return true
+	}
+	return !vector.Less(a.elem, b.elem) && a.seq > b.seq
+}
+
+// topRows A max-heap holding the smallest rows seen so far, the last one on top.
+type topRows []*topRow
+
+func (h topRows) Len() int            { return len(h) }
+func (h topRows) Less(i, j int) bool  { return h[i].after(h[j]) }
+func (h topRows) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *topRows) Push(x interface{}) { *h = append(*h, x.(*topRow)) }
+
+func (h *topRows) Pop() interface{} {
+	old := *h
+	row := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return row
+}
+
+// sortTopRows Scan the whole input keeping only the first Limit rows in a bounded heap,
+// then sort them in memory. No chunk is written.
+func (f *Info) sortTopRows(scanner *inputs) error {
+	h := make(topRows, 0, f.Limit)
+	seq := 0
+	for scanner.Scan() {
+		f.collectMemUsage()
+		line := scanner.Text()
+		k, err := f.Allocate.Key(line)
+		if err != nil {
+			source, row, offset := scanner.position()
+			err = f.badRows.add(&RowError{Err: err, Text: line, Source: source, Line: row, Offset: offset})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		row := &topRow{elem: &vector.Element{Line: line, Key: k}, seq: seq}
+		seq++
+		if len(h) < f.Limit {
+			heap.Push(&h, row)
+			continue
+		}
+		if h[0].after(row) {
+			h[0] = row
+			heap.Fix(&h, 0)
+		}
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	// the rows are sorted like a chunk, starting from the input order
+	sort.Slice(h, func(i, j int) bool {
+		return h[i].seq < h[j].seq
+	})
+	block := batchingchannels.Block{Lines: make([]string, 0, len(h))}
+	for _, row := range h {
+		block.Lines = append(block.Lines, row.elem.Line)
+	}
+	return f.sortInMemory(block)
+}
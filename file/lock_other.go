@@ -0,0 +1,43 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package file
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// lockJobDir Create the lock file of dir, it fails if the file exists.
+// A lock file that has not been refreshed for two refresh intervals belongs to a crashed job and is taken over.
+func lockJobDir(dir string) (*os.File, error) {
+	lockPath := path.Join(dir, lockFileName)
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o644)
+	if os.IsExist(err) {
+		info, statErr := os.Stat(lockPath)
+		if statErr == nil && time.Since(info.ModTime()) >= 2*lockRefreshInterval {
+			err = os.Remove(lockPath)
+			if err == nil || os.IsNotExist(err) {
+				lock, err = os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o644)
+			}
+		}
+	}
+	if os.IsExist(err) {
+		return nil, errJobRunning
+	}
+	return lock, err
+}
+
+// unlockJobDir Close the lock file of dir and remove it.
+func unlockJobDir(dir string, lock *os.File) error {
+	err := lock.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path.Join(dir, lockFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
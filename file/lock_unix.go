@@ -0,0 +1,56 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package file
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockJobDir Create the lock file of dir and take an exclusive lock on it.
+// The lock is held until the file is closed or the process exits, so a crashed job never keeps it.
+func lockJobDir(dir string) (*os.File, error) {
+	lockPath := path.Join(dir, lockFileName)
+	for {
+		lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			lock.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, errJobRunning
+			}
+			return nil, err
+		}
+		// the previous owner may have removed the file before it was locked
+		held, err := lock.Stat()
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		current, err := os.Stat(lockPath)
+		if err == nil && os.SameFile(held, current) {
+			return lock, nil
+		}
+		lock.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// unlockJobDir Remove the lock file of dir before releasing its lock.
+func unlockJobDir(dir string, lock *os.File) error {
+	err := os.Remove(path.Join(dir, lockFileName))
+	if err != nil && !os.IsNotExist(err) {
+		lock.Close()
+		return err
+	}
+	return lock.Close()
+}
@@ -0,0 +1,229 @@
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/askiada/external-sort/file/chunkfile"
+	"github.com/pkg/errors"
+)
+
+const manifestFileName = "manifest.json"
+
+// Manifest Describe the chunks created by CreateSortedChunks.
+// It is written in the job folder when Resume is enabled, so a failed merge
+// can be restarted without scanning the input again.
+type Manifest struct {
+	Input     InputIdentity   `json:"input"`
+	KeySpec   string          `json:"key_spec"`
+	Chunks    []ManifestChunk `json:"chunks"`
+	DumpSize  int             `json:"dump_size"`
+	TotalRows int             `json:"total_rows"`
+	// Limit the chunks only hold their first Limit rows.
+	Limit int `json:"limit,omitempty"`
+	// Framing name of the framing of the input rows, empty for one row per line.
+	Framing string `json:"framing,omitempty"`
+	// ChunkFolders absolute paths of the chunk folders, ManifestChunk.Dir is an index in this list.
+	ChunkFolders []string `json:"chunk_folders"`
+	// Reduce type and settings of the Reducer, empty without Reduce.
+	Reduce  string `json:"reduce,omitempty"`
+	Combine bool   `json:"combine,omitempty"`
+	Stable  bool   `json:"stable,omitempty"`
+	// SourceColumn the rows of the chunks end with the name of their input.
+	SourceColumn  bool `json:"source_column,omitempty"`
+	MaxRecordSize int  `json:"max_record_size,omitempty"`
+}
+
+// InputIdentity Identify the input file of a sort.
+type InputIdentity struct {
+	ModTime time.Time `json:"mod_time"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+}
+
+// ManifestChunk Describe a chunk file using its footer.
+type ManifestChunk struct {
+	// Name file name of the chunk inside the job folder.
+	Name string `json:"name"`
+	// Dir index of the chunk folder holding the chunk.
+	Dir      int    `json:"dir"`
+	Rows     uint64 `json:"rows"`
+	Size     uint64 `json:"size"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// newManifest Create an empty manifest for the input of the sort and its chunk folders.
+func (f *Info) newManifest(dumpSize int, chunkFolders []string) (*Manifest, error) {
+	if f.InputPath == "" {
+		return nil, errors.New("resume requires the input path")
+	}
+	inputPath, err := filepath.Abs(f.InputPath)
+	if err != nil {
+		return nil, err
+	}
+	folders := make([]string, 0, len(chunkFolders))
+	for _, chunkFolder := range chunkFolders {
+		folder, err := filepath.Abs(chunkFolder)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	stat, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	framing := ""
+	if f.binaryChunks() {
+		framing = f.Framing.String()
+	}
+	reduce := ""
+	if f.Reduce != nil {
+		reduce = fmt.Sprintf("%T%+v", f.Reduce, f.Reduce)
+	}
+	return &Manifest{
+		Input: InputIdentity{
+			Path:    inputPath,
+			Size:    stat.Size(),
+			ModTime: stat.ModTime(),
+		},
+		KeySpec:       f.KeySpec,
+		DumpSize:      dumpSize,
+		Limit:         f.Limit,
+		Framing:       framing,
+		ChunkFolders:  folders,
+		Reduce:        reduce,
+		Combine:       f.Combine,
+		Stable:        f.Stable,
+		SourceColumn:  f.SourceColumn,
+		MaxRecordSize: f.MaxRecordSize,
+	}, nil
+}
+
+// jobName returns a name that only depends on the input and the settings of the sort.
+func (m *Manifest) jobName() string {
+	h := sha256.New()
+	h.Write([]byte(m.Input.Path + "\x00" + strconv.FormatInt(m.Input.Size, 10) + "\x00" + m.Input.ModTime.UTC().String() + "\x00"))
+	h.Write([]byte(m.KeySpec + "\x00" + strconv.Itoa(m.DumpSize)))
+	if m.Limit > 0 {
+		h.Write([]byte("\x00" + strconv.Itoa(m.Limit)))
+	}
+	if m.Framing != "" {
+		h.Write([]byte("\x00" + m.Framing))
+	}
+	if m.Reduce != "" {
+		h.Write([]byte("\x00reduce " + m.Reduce + " " + strconv.FormatBool(m.Combine)))
+	}
+	if m.Stable {
+		h.Write([]byte("\x00stable"))
+	}
+	if m.SourceColumn {
+		h.Write([]byte("\x00source"))
+	}
+	if m.MaxRecordSize > 0 {
+		h.Write([]byte("\x00max " + strconv.Itoa(m.MaxRecordSize)))
+	}
+	// the chunks are found by the index of their chunk folder
+	for _, folder := range m.ChunkFolders {
+		h.Write([]byte("\x00" + folder))
+	}
+	return "resume-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// matches returns wether other describes the same input sorted with the same settings.
+func (m *Manifest) matches(other *Manifest) bool {
+	return m.Input.Path == other.Input.Path &&
+		m.Input.Size == other.Input.Size &&
+		m.Input.ModTime.Equal(other.Input.ModTime) &&
+		m.KeySpec == other.KeySpec &&
+		m.DumpSize == other.DumpSize &&
+		m.Limit == other.Limit &&
+		m.Framing == other.Framing &&
+		m.Reduce == other.Reduce &&
+		m.Combine == other.Combine &&
+		m.Stable == other.Stable &&
+		m.SourceColumn == other.SourceColumn &&
+		m.MaxRecordSize == other.MaxRecordSize &&
+		equalStrings(m.ChunkFolders, other.ChunkFolders)
+}
+
+// equalStrings returns wether a and b hold the same strings in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addChunk Record a chunk written in the job folder of the chunk folder dirIdx.
+func (m *Manifest) addChunk(dirIdx int, chunkPath string, footer *chunkfile.Footer) {
+	m.Chunks = append(m.Chunks, ManifestChunk{
+		Name:     path.Base(chunkPath),
+		Dir:      dirIdx,
+		Rows:     footer.Rows,
+		Size:     footer.Size,
+		Checksum: footer.Checksum,
+	})
+}
+
+// verify Read all the chunks in the job folders and check them against the manifest.
+// It returns the paths of the chunks.
+func (m *Manifest) verify(dirs []string) ([]string, error) {
+	chunkPaths := make([]string, 0, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		if chunk.Dir < 0 || chunk.Dir >= len(dirs) {
+			return nil, errors.Errorf("chunk %s is in an unknown folder", chunk.Name)
+		}
+		chunkPath := path.Join(dirs[chunk.Dir], chunk.Name)
+		footer, err := chunkfile.Verify(chunkPath)
+		if err != nil {
+			return nil, err
+		}
+		if footer.Rows != chunk.Rows || footer.Size != chunk.Size || footer.Checksum != chunk.Checksum {
+			return nil, errors.Errorf("chunk %s does not match the manifest", chunkPath)
+		}
+		chunkPaths = append(chunkPaths, chunkPath)
+	}
+	return chunkPaths, nil
+}
+
+// write Store the manifest in dir. The manifest is only visible once completely written.
+func (m *Manifest) write(dir string) error {
+	fn := "write manifest"
+	out, err := CreateAtomicFile(path.Join(dir, manifestFileName))
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	err = json.NewEncoder(out).Encode(m)
+	if err != nil {
+		out.Abort()
+		return errors.Wrap(err, fn)
+	}
+	return errors.Wrap(out.Commit(), fn)
+}
+
+// readManifest Load the manifest stored in dir.
+func readManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(path.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	return m, nil
+}
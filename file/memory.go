@@ -0,0 +1,102 @@
+package file
+
+import (
+	"context"
+	"time"
+
+	"github.com/askiada/external-sort/file/batchingchannels"
+)
+
+// prefetch Read the first rows of the inputs until it holds more than dumpSize rows
+// and more than InMemorySize bytes. It returns true if all the inputs were read.
+func (f *Info) prefetch(scanner *inputs, dumpSize int) (*batchingchannels.Block, bool, error) {
+	block := &batchingchannels.Block{}
+	size := int64(0)
+	for len(block.Lines) <= dumpSize || size <= f.InMemorySize {
+		if !scanner.Scan() {
+			return block, true, scanner.Err()
+		}
+		f.collectMemUsage()
+		line := scanner.Text()
+		source, row, offset := scanner.position()
+		block.Lines = append(block.Lines, line)
+		block.Offsets = append(block.Offsets, offset)
+		block.AddSpan(batchingchannels.Span{Source: source, Line: row, Len: 1})
+		size += int64(len(line)) + rowOverhead
+	}
+	return block, false, nil
+}
+
+// sortSmallInput Prefetch the first rows of the input and sort them in memory if they are the whole input.
+// It returns the prefetched rows and whether the input was sorted in memory.
+func (f *Info) sortSmallInput(scanner *inputs, dumpSize int) (*batchingchannels.Block, bool, error) {
+	block, eof, err := f.prefetch(scanner, dumpSize)
+	if err != nil || !eof {
+		return block, false, err
+	}
+	err = f.sortInMemory(*block)
+	if err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// sortInMemory Sort the rows of the whole input the same way a chunk is sorted.
+func (f *Info) sortInMemory(block batchingchannels.Block) error {
+	v := f.Allocate.Vector(len(block.Lines), f.Allocate.Key)
+	err := f.allocateRows(v, block)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if f.stable() {
+		v.SortStable()
+	} else {
+		v.Sort()
+	}
+	if f.Limit > 0 {
+		v.Truncate(f.Limit)
+	}
+	f.runStats.update(func(report *Stats) {
+		report.Durations.Sort += time.Since(start).Seconds()
+		report.InMemory = true
+	})
+	f.memory = v
+	f.totalRows = v.Len()
+	return nil
+}
+
+// writeMemory Write the rows sorted in memory by CreateSortedChunks to the output.
+func (f *Info) writeMemory(ctx context.Context) (err error) {
+	rows := f.memory
+	f.memory = nil
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+	w, outputFile, err := f.openRowOutput(memorySplitters(rows))
+	if err != nil {
+		return err
+	}
+	if f.Reduce != nil {
+		w = f.newReduceWriter(w, rows.Len())
+	}
+	defer func() {
+		if err != nil {
+			outputFile.Abort()
+		}
+	}()
+	n := int64(rows.Len())
+	f.progress().Start(PhaseMerge, n)
+	err = w.writeRows(rows)
+	if err != nil {
+		return err
+	}
+	f.progress().Advance(PhaseMerge, n)
+	err = w.flush()
+	if err != nil {
+		return err
+	}
+	f.progress().Finish(PhaseMerge)
+	return outputFile.Commit()
+}
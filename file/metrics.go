@@ -0,0 +1,125 @@
+package file
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics Receive the measures of a sort while it runs.
+// Methods can be called from several goroutines at the same time.
+type Metrics interface {
+	// AddRowsScanned count rows read from the input.
+	AddRowsScanned(n int64)
+	// AddChunksWritten count chunk files written, including the runs of the cascade.
+	AddChunksWritten(n int64)
+	// SetChunkBytes set the size of the chunk files written by the sort and still on disk.
+	SetChunkBytes(bytes int64)
+	// AddMergeRows count rows written to the output.
+	AddMergeRows(n int64)
+	// AddOpenChunks change the number of chunk files open for a merge.
+	AddOpenChunks(delta int64)
+	// SetMemUsage set the memory allocated and obtained from the system, in bytes.
+	SetMemUsage(alloc, sys uint64)
+}
+
+// NoMetrics Ignore the metrics.
+type NoMetrics struct{}
+
+func (NoMetrics) AddRowsScanned(int64)       {}
+func (NoMetrics) AddChunksWritten(int64)     {}
+func (NoMetrics) SetChunkBytes(int64)        {}
+func (NoMetrics) AddMergeRows(int64)         {}
+func (NoMetrics) AddOpenChunks(int64)        {}
+func (NoMetrics) SetMemUsage(uint64, uint64) {}
+
+// PrometheusMetrics Keep the metrics of a sort and serve them in the Prometheus text format.
+type PrometheusMetrics struct {
+	// 64-bit values first to be aligned for atomic operations.
+	rowsScanned   int64
+	chunksWritten int64
+	chunkBytes    int64
+	mergeRows     int64
+	openChunks    int64
+	memAlloc      uint64
+	memSys        uint64
+}
+
+// NewPrometheusMetrics returns metrics served by their ServeHTTP method.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{}
+}
+
+func (m *PrometheusMetrics) AddRowsScanned(n int64) {
+	atomic.AddInt64(&m.rowsScanned, n)
+}
+
+func (m *PrometheusMetrics) AddChunksWritten(n int64) {
+	atomic.AddInt64(&m.chunksWritten, n)
+}
+
+func (m *PrometheusMetrics) SetChunkBytes(bytes int64) {
+	atomic.StoreInt64(&m.chunkBytes, bytes)
+}
+
+func (m *PrometheusMetrics) AddMergeRows(n int64) {
+	atomic.AddInt64(&m.mergeRows, n)
+}
+
+func (m *PrometheusMetrics) AddOpenChunks(delta int64) {
+	atomic.AddInt64(&m.openChunks, delta)
+}
+
+func (m *PrometheusMetrics) SetMemUsage(alloc, sys uint64) {
+	atomic.StoreUint64(&m.memAlloc, alloc)
+	atomic.StoreUint64(&m.memSys, sys)
+}
+
+// ServeHTTP Write the current value of every metric in the Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics := []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"external_sort_rows_scanned_total", "counter", "Rows read from the input.", atomic.LoadInt64(&m.rowsScanned)},
+		{"external_sort_chunks_written_total", "counter", "Chunk files written, including the runs of the cascade.", atomic.LoadInt64(&m.chunksWritten)},
+		{"external_sort_chunk_bytes", "gauge", "Size of the chunk files still on disk.", atomic.LoadInt64(&m.chunkBytes)},
+		{"external_sort_merge_rows_total", "counter", "Rows written to the output.", atomic.LoadInt64(&m.mergeRows)},
+		{"external_sort_open_chunk_files", "gauge", "Chunk files open for a merge.", atomic.LoadInt64(&m.openChunks)},
+		{"external_sort_memory_alloc_bytes", "gauge", "Bytes of allocated heap objects at the last sample.", atomic.LoadUint64(&m.memAlloc)},
+		{"external_sort_memory_sys_bytes", "gauge", "Bytes obtained from the system at the last sample.", atomic.LoadUint64(&m.memSys)},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
+
+// metrics returns the metrics of the sort.
+func (f *Info) metrics() Metrics {
+	if f.Metrics == nil {
+		return NoMetrics{}
+	}
+	return f.Metrics
+}
+
+// addChunkBytes Change the size of the chunk files on disk and report it.
+func (f *Info) addChunkBytes(delta int64) {
+	var total int64
+	f.runStats.update(func(report *Stats) {
+		f.runStats.chunkBytes += delta
+		total = f.runStats.chunkBytes
+	})
+	f.metrics().SetChunkBytes(total)
+}
+
+// clearChunkBytes Report that the chunk files of the sort are not on disk anymore.
+func (f *Info) clearChunkBytes() {
+	if f.runStats == nil {
+		return
+	}
+	f.runStats.update(func(report *Stats) {
+		f.runStats.chunkBytes = 0
+	})
+	f.metrics().SetChunkBytes(0)
+}
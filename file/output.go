@@ -0,0 +1,109 @@
+package file
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// AtomicWriter is an output that only becomes visible at its final path once committed.
+type AtomicWriter interface {
+	io.Writer
+	// Commit makes the content durable and publishes it at its final path.
+	Commit() error
+	// Abort discards everything written so far.
+	Abort() error
+}
+
+var _ AtomicWriter = &atomicFile{}
+
+// writerAt An output implementing io.WriterAt only when the output it wraps does.
+type writerAt interface {
+	io.WriterAt
+	canWriteAt() bool
+}
+
+// canWriteAt returns true if w can be written at any offset with WriteAt.
+func canWriteAt(w io.Writer) bool {
+	if o, ok := w.(writerAt); ok {
+		return o.canWriteAt()
+	}
+	_, ok := w.(io.WriterAt)
+	return ok
+}
+
+// atomicFile writes to a temporary file next to the final path and renames it on commit.
+type atomicFile struct {
+	file *os.File
+	path string
+}
+
+// CreateAtomicFile Create a temporary file in the same directory as path.
+// The temporary file replaces path only when Commit is called.
+func CreateAtomicFile(path string) (AtomicWriter, error) {
+	fn := "create atomic file"
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	err = f.Chmod(0o644)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, fn)
+	}
+	return &atomicFile{file: f, path: path}, nil
+}
+
+func (a *atomicFile) Write(p []byte) (int, error) {
+	return a.file.Write(p)
+}
+
+// WriteAt Write p at the offset off of the temporary file.
+func (a *atomicFile) WriteAt(p []byte, off int64) (int, error) {
+	return a.file.WriteAt(p, off)
+}
+
+// Commit Sync the temporary file, rename it to its final path and sync the parent directory
+// so the rename survives a crash.
+func (a *atomicFile) Commit() error {
+	fn := "commit"
+	err := a.file.Sync()
+	if err != nil {
+		a.Abort()
+		return errors.Wrap(err, fn)
+	}
+	err = a.file.Close()
+	if err != nil {
+		os.Remove(a.file.Name())
+		return errors.Wrap(err, fn)
+	}
+	err = os.Rename(a.file.Name(), a.path)
+	if err != nil {
+		os.Remove(a.file.Name())
+		return errors.Wrap(err, fn)
+	}
+	return errors.Wrap(syncDir(filepath.Dir(a.path)), fn)
+}
+
+// Abort Close and remove the temporary file. The final path is left untouched.
+func (a *atomicFile) Abort() error {
+	a.file.Close()
+	err := os.Remove(a.file.Name())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "abort")
+	}
+	return nil
+}
+
+// syncDir Flush the directory entries of a folder to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
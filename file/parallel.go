@@ -0,0 +1,323 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/askiada/external-sort/file/chunkfile"
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/vector"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/pkg/errors"
+)
+
+// chunkIndex The sparse index of a chunk and the key of every indexed row.
+type chunkIndex struct {
+	path    string
+	entries []chunkfile.IndexEntry
+	keys    []*vector.Element
+	size    int64
+	rows    int
+}
+
+// readChunkIndex Read the index of a chunk and allocate the key of every indexed row.
+// The rows of the sections read later are verified against the index.
+func (f *Info) readChunkIndex(chunkPath string) (*chunkIndex, error) {
+	entries, footer, err := chunkfile.ReadIndex(chunkPath)
+	if err != nil {
+		return nil, err
+	}
+	idx := &chunkIndex{
+		path:    chunkPath,
+		entries: entries,
+		keys:    make([]*vector.Element, 0, len(entries)),
+		size:    int64(footer.Size),
+		rows:    int(footer.Rows),
+	}
+	for _, entry := range entries {
+		k, err := f.Allocate.Key(entry.Line)
+		if err != nil {
+			return nil, err
+		}
+		idx.keys = append(idx.keys, &vector.Element{Line: entry.Line, Key: k})
+	}
+	return idx, nil
+}
+
+// boundary returns the offset of the first row of the chunk that is not smaller than splitter.
+// The index locates the rows between two entries, only those rows are read.
+func (f *Info) boundary(idx *chunkIndex, splitter *vector.Element) (int64, error) {
+	i := sort.Search(len(idx.keys), func(i int) bool {
+		return !vector.Less(idx.keys[i], splitter)
+	})
+	if i == 0 {
+		return 0, nil
+	}
+	start := idx.entries[i-1].Offset
+	end := idx.size
+	if i < len(idx.entries) {
+		end = idx.entries[i].Offset
+	}
+	reader, err := chunkfile.OpenSection(idx.path, idx.entries, start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	offset := start
+	for reader.Scan() {
+		line := reader.Text()
+		k, err := f.Allocate.Key(line)
+		if err != nil {
+			return 0, err
+		}
+		if !k.Less(splitter.Key) {
+			return offset, nil
+		}
+		offset += chunkfile.RowSize(line, reader.Footer().Binary)
+	}
+	return end, reader.Err()
+}
+
+// readChunkIndexes Read the index of every chunk in parallel.
+func (f *Info) readChunkIndexes(chunkPaths []string) ([]*chunkIndex, error) {
+	indexes := make([]*chunkIndex, len(chunkPaths))
+	g := &errgroup.Group{}
+	sem := make(chan struct{}, openParallelism)
+	for i, chunkPath := range chunkPaths {
+		i, chunkPath := i, chunkPath
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			idx, err := f.readChunkIndex(chunkPath)
+			indexes[i] = idx
+			return err
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+// minSamples minimum number of keys sampled from the chunk indexes per range.
+// With fewer keys, all the rows of the chunks are read to find the splitters.
+const minSamples = 64
+
+// sampleSplitters returns at most n-1 increasing keys cutting the rows of the chunks in n ranges
+// holding a similar number of rows. The keys are sampled from the chunk indexes,
+// unless they hold too few keys: the chunks are then small enough to read all their rows.
+func (f *Info) sampleSplitters(indexes []*chunkIndex, n int) ([]*vector.Element, error) {
+	samples := []*vector.Element{}
+	for _, idx := range indexes {
+		samples = append(samples, idx.keys...)
+	}
+	if len(samples) < n*minSamples {
+		samples = samples[:0]
+		for _, idx := range indexes {
+			rows, err := f.readKeys(idx)
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, rows...)
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return vector.Less(samples[i], samples[j])
+	})
+	return quantiles(len(samples), func(i int) *vector.Element { return samples[i] }, n), nil
+}
+
+// readKeys returns all the rows of a chunk and their keys.
+func (f *Info) readKeys(idx *chunkIndex) ([]*vector.Element, error) {
+	reader, err := chunkfile.Open(idx.path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	rows := make([]*vector.Element, 0, idx.rows)
+	for reader.Scan() {
+		line := reader.Text()
+		k, err := f.Allocate.Key(line)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, &vector.Element{Line: line, Key: k})
+	}
+	return rows, reader.Err()
+}
+
+// quantiles returns at most n-1 distinct keys at the quantiles of size sorted rows,
+// get returning the i-th row.
+func quantiles(size int, get func(i int) *vector.Element, n int) []*vector.Element {
+	splitters := []*vector.Element{}
+	for r := 1; r < n && size > 0; r++ {
+		splitter := get(r * size / n)
+		if len(splitters) > 0 && !vector.Less(splitters[len(splitters)-1], splitter) {
+			continue
+		}
+		splitters = append(splitters, splitter)
+	}
+	return splitters
+}
+
+// splitRanges Cut the keys of the chunks in at most workers ranges holding a similar number of rows.
+// The splitters are sampled from the chunk indexes, so rows with equal keys always end up in the same range.
+// It returns for every range the section of each chunk holding its rows.
+func (f *Info) splitRanges(chunkPaths []string, workers int) ([][]section, error) {
+	indexes, err := f.readChunkIndexes(chunkPaths)
+	if err != nil {
+		return nil, err
+	}
+	splitters, err := f.sampleSplitters(indexes, workers)
+	if err != nil {
+		return nil, err
+	}
+
+	// offsets[i][r] is the beginning of the range r in the chunk i
+	g := &errgroup.Group{}
+	sem := make(chan struct{}, openParallelism)
+	offsets := make([][]int64, len(indexes))
+	for i, idx := range indexes {
+		i, idx := i, idx
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+			offsets[i] = make([]int64, 0, len(splitters)+2)
+			offsets[i] = append(offsets[i], 0)
+			for _, splitter := range splitters {
+				offset, err := f.boundary(idx, splitter)
+				if err != nil {
+					return err
+				}
+				offsets[i] = append(offsets[i], offset)
+			}
+			offsets[i] = append(offsets[i], idx.size)
+			return nil
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make([][]section, len(splitters)+1)
+	for i, idx := range indexes {
+		for r := range ranges {
+			start, end := offsets[i][r], offsets[i][r+1]
+			if start < end {
+				ranges[r] = append(ranges[r], section{path: idx.path, start: start, end: end, index: idx.entries})
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// mergesInParallel returns true if the ranges of keys of the chunks are merged in parallel by parallelMergeSort.
+// Ranges can not be cut off after Limit rows or reduced, they are written to a single output file,
+// and a row must take as many bytes in the output as in the chunks. The output must also be an io.WriterAt,
+// see canWriteAt.
+func (f *Info) mergesInParallel(chunkPaths []string) bool {
+	return f.MergeWorkers > 1 && len(chunkPaths) > 1 &&
+		f.Limit == 0 && f.Reduce == nil && f.Partitioning == nil && f.GroupBy == nil &&
+		(f.framing() == framing.Newline || f.framing() == framing.LengthPrefixed)
+}
+
+// parallelMergeSort Merge every range of keys with MergeWorkers workers, straight into the output.
+// The rows of a range take as many bytes in the output as in its chunk sections,
+// so every range is written at its own offset of outputFile while the others are merged.
+// outputFile is aborted if the merge fails.
+func (f *Info) parallelMergeSort(ctx context.Context, chunkPaths []string, k int, outputFile AtomicWriter) (err error) {
+	fn := "parallel merge"
+	defer func() {
+		if err != nil {
+			outputFile.Abort()
+		}
+	}()
+	ranges, err := f.splitRanges(chunkPaths, f.MergeWorkers)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	output, ok := outputFile.(io.WriterAt)
+	if !ok {
+		return errors.Wrap(errors.New("the output can not be written at an offset"), fn)
+	}
+
+	f.progress().Start(PhaseMerge, int64(f.outputRows()))
+	g, gctx := errgroup.WithContext(ctx)
+	budget := f.newBudget()
+	offset := int64(0)
+	for _, sections := range ranges {
+		sections := sections
+		w := &offsetWriter{w: output, offset: offset}
+		for _, s := range sections {
+			offset += s.end - s.start
+		}
+		end := offset
+		g.Go(func() error {
+			err := f.mergeRange(gctx, sections, k, w, budget)
+			if err == nil && w.offset != end {
+				err = errors.Errorf("range written up to %d instead of %d", w.offset, end)
+			}
+			return err
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	f.progress().Finish(PhaseMerge)
+	if f.job == nil || !f.job.resumable {
+		for _, chunkPath := range chunkPaths {
+			err = os.Remove(chunkPath)
+			if err != nil {
+				return errors.Wrap(err, fn)
+			}
+		}
+	}
+	return outputFile.Commit()
+}
+
+// mergeRange Merge the sections of a range of keys to w.
+func (f *Info) mergeRange(ctx context.Context, sections []section, k int, w io.Writer, budget *semaphore.Weighted) (err error) {
+	// the chunk files are shared by all the ranges
+	chunks := &chunks{
+		list:      make([]*chunkInfo, 0, len(sections)),
+		keepFiles: true,
+		metrics:   f.metrics(),
+	}
+	err = chunks.open(sections, f.Allocate, k)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			chunks.close()
+		}
+	}()
+	if f.ReadAhead {
+		chunks.startReadAhead(f.Allocate, k, budget)
+	}
+	err = f.merge(ctx, chunks, k, textWriter{bufio.NewWriter(w), f.runStats, f.metrics(), f.framing()}, f.progress())
+	if err != nil {
+		return err
+	}
+	return chunks.close()
+}
+
+// offsetWriter Write to w from offset onwards.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,276 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/askiada/external-sort/vector"
+
+	"github.com/pkg/errors"
+)
+
+// Partitioning Split the output in several files of increasing and non-overlapping key ranges.
+// Rows with equal keys are always written to the same file.
+type Partitioning struct {
+	// Rows start a new file once the current one holds at least Rows rows. 0 means no limit.
+	Rows int
+	// Size start a new file once the current one holds at least Size bytes. 0 means no limit.
+	Size int64
+	// Parts split the output in Parts files at quantiles of the keys sampled from the chunks.
+	Parts int
+	// KeyText returns the key of a row as written in the manifest. The whole row is written if it is nil.
+	KeyText func(line string) (string, error)
+}
+
+// PartitionManifest Describe the files of a partitioned output, in ascending order of keys.
+// It is written next to the files once all of them are complete.
+type PartitionManifest struct {
+	KeySpec string          `json:"key_spec"`
+	Parts   []PartitionFile `json:"parts"`
+}
+
+// PartitionFile Describe a file of a partitioned output.
+type PartitionFile struct {
+	// Name file name of the part, in the folder of the manifest.
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	Size   int64  `json:"size"`
+	MinKey string `json:"min_key"`
+	MaxKey string `json:"max_key"`
+}
+
+// PartPath returns the path of the i-th file of a partitioned output, e.g. out-00002.tsv for out.tsv.
+func PartPath(outputPath string, i int) string {
+	ext := filepath.Ext(outputPath)
+	return fmt.Sprintf("%s-%05d%s", strings.TrimSuffix(outputPath, ext), i, ext)
+}
+
+// PartitionManifestPath returns the path of the manifest of a partitioned output, e.g. out.manifest.json for out.tsv.
+func PartitionManifestPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".manifest.json"
+}
+
+// newTextWriter returns a writer of the rows to a single output.
+func (f *Info) newTextWriter(output io.Writer) rowWriter {
+	return textWriter{bufio.NewWriter(output), f.runStats, f.metrics(), f.framing()}
+}
+
+// committer An output published once all the rows are written, or discarded.
+type committer interface {
+	Commit() error
+	Abort() error
+}
+
+// openRowOutput Open the destination of the merged rows, split in files if Partitioning or GroupBy is set.
+// splitters returns the keys cutting the rows in n ranges, it is only called for Partitioning.Parts.
+func (f *Info) openRowOutput(splitters func(n int) ([]*vector.Element, error)) (rowWriter, committer, error) {
+	if f.GroupBy != nil {
+		gw, err := f.newGroupWriter()
+		if err != nil {
+			return nil, nil, err
+		}
+		return gw, gw, nil
+	}
+	if f.Partitioning == nil {
+		outputFile, err := f.openOutput()
+		if err != nil {
+			return nil, nil, err
+		}
+		return f.newTextWriter(outputFile), outputFile, nil
+	}
+	p := f.Partitioning
+	if p.Rows <= 0 && p.Size <= 0 && p.Parts <= 0 {
+		return nil, nil, errors.New("partitioning requires a number of rows, a size or a number of parts")
+	}
+	pw := &partitionWriter{f: f, manifest: PartitionManifest{Parts: []PartitionFile{}}}
+	if p.Parts > 1 {
+		var err error
+		pw.splitters, err = splitters(p.Parts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pw, pw, nil
+}
+
+// partitionWriter Write the merged rows in consecutive files, starting a new one
+// when the current one is full or a splitter is reached, but never between equal keys.
+// Every file is published once complete, the manifest once they all are.
+type partitionWriter struct {
+	f         *Info
+	splitters []*vector.Element
+	current   AtomicWriter
+	w         *bufio.Writer
+	last      *vector.Element
+	manifest  PartitionManifest
+	framed    []byte
+}
+
+// next returns whether row must be written to a new file.
+func (pw *partitionWriter) next(row *vector.Element) bool {
+	crossed := false
+	for len(pw.splitters) > 0 && !vector.Less(row, pw.splitters[0]) {
+		pw.splitters = pw.splitters[1:]
+		crossed = true
+	}
+	if pw.current == nil {
+		return true
+	}
+	if !vector.Less(pw.last, row) {
+		return false
+	}
+	p := pw.f.Partitioning
+	part := pw.manifest.Parts[len(pw.manifest.Parts)-1]
+	return crossed || (p.Rows > 0 && part.Rows >= int64(p.Rows)) || (p.Size > 0 && part.Size >= p.Size)
+}
+
+// keyText returns the key of the row written in the manifest.
+func (pw *partitionWriter) keyText(line string) (string, error) {
+	if pw.f.Partitioning.KeyText == nil {
+		return line, nil
+	}
+	return pw.f.Partitioning.KeyText(line)
+}
+
+// open Publish the current file and start the next one with row.
+func (pw *partitionWriter) open(row *vector.Element) error {
+	err := pw.commitCurrent()
+	if err != nil {
+		return err
+	}
+	partPath := PartPath(pw.f.OutputPath, len(pw.manifest.Parts))
+	pw.current, err = pw.f.openPath(partPath)
+	if err != nil {
+		return err
+	}
+	pw.w = bufio.NewWriter(pw.current)
+	minKey, err := pw.keyText(row.Line)
+	if err != nil {
+		return err
+	}
+	pw.manifest.Parts = append(pw.manifest.Parts, PartitionFile{Name: path.Base(partPath), MinKey: minKey})
+	return nil
+}
+
+// commitCurrent Flush and publish the current file.
+func (pw *partitionWriter) commitCurrent() error {
+	if pw.current == nil {
+		return nil
+	}
+	maxKey, err := pw.keyText(pw.last.Line)
+	if err != nil {
+		return err
+	}
+	pw.manifest.Parts[len(pw.manifest.Parts)-1].MaxKey = maxKey
+	err = pw.w.Flush()
+	if err != nil {
+		return err
+	}
+	err = pw.current.Commit()
+	pw.current = nil
+	return err
+}
+
+func (pw *partitionWriter) writeRows(rows vector.Vector) error {
+	n := int64(rows.Len())
+	pw.f.runStats.update(func(report *Stats) {
+		report.RowsWritten += n
+	})
+	pw.f.metrics().AddMergeRows(n)
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Get(i)
+		if pw.next(row) {
+			err := pw.open(row)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		pw.framed, err = pw.f.framing().Append(pw.framed[:0], row.Line)
+		if err != nil {
+			return err
+		}
+		_, err = pw.w.Write(pw.framed)
+		if err != nil {
+			return err
+		}
+		part := &pw.manifest.Parts[len(pw.manifest.Parts)-1]
+		part.Rows++
+		part.Size += int64(len(pw.framed))
+		pw.last = row
+	}
+	if n > 0 {
+		// the rows of the vector can be reused once written
+		last := *pw.last
+		pw.last = &last
+	}
+	rows.Reset()
+	return nil
+}
+
+func (pw *partitionWriter) flush() error {
+	if pw.current == nil {
+		return nil
+	}
+	return pw.w.Flush()
+}
+
+// Commit Publish the last file and write the manifest.
+func (pw *partitionWriter) Commit() error {
+	fn := "commit partitions"
+	err := pw.commitCurrent()
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	pw.manifest.KeySpec = pw.f.KeySpec
+	openOutput := pw.f.OpenOutput
+	if openOutput == nil {
+		openOutput = CreateAtomicFile
+	}
+	// the manifest is not counted in the bytes written
+	out, err := openOutput(PartitionManifestPath(pw.f.OutputPath))
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(pw.manifest)
+	if err != nil {
+		out.Abort()
+		return errors.Wrap(err, fn)
+	}
+	return errors.Wrap(out.Commit(), fn)
+}
+
+// Abort Discard the current file. The files already complete are kept, but no manifest is written.
+func (pw *partitionWriter) Abort() error {
+	if pw.current == nil {
+		return nil
+	}
+	err := pw.current.Abort()
+	pw.current = nil
+	return err
+}
+
+// chunkSplitters returns the keys cutting the rows of the chunks in n ranges.
+func (f *Info) chunkSplitters(chunkPaths []string) func(n int) ([]*vector.Element, error) {
+	return func(n int) ([]*vector.Element, error) {
+		indexes, err := f.readChunkIndexes(chunkPaths)
+		if err != nil {
+			return nil, err
+		}
+		return f.sampleSplitters(indexes, n)
+	}
+}
+
+// memorySplitters returns the keys cutting the sorted rows in n ranges.
+func memorySplitters(rows vector.Vector) func(n int) ([]*vector.Element, error) {
+	return func(n int) ([]*vector.Element, error) {
+		return quantiles(rows.Len(), rows.Get, n), nil
+	}
+}
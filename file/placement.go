@@ -0,0 +1,111 @@
+package file
+
+import (
+	"math"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ChunkDir A folder where the chunks can be written.
+type ChunkDir struct {
+	Path string
+	// Quota maximum number of bytes of chunks stored in the folder at the same time. 0 means no limit.
+	Quota int64
+}
+
+// ChunkDirs Create a ChunkDir without quota for every path.
+func ChunkDirs(paths ...string) []ChunkDir {
+	dirs := make([]ChunkDir, 0, len(paths))
+	for _, p := range paths {
+		dirs = append(dirs, ChunkDir{Path: p})
+	}
+	return dirs
+}
+
+// Placement Decide in which folder a new chunk is written.
+type Placement int
+
+const (
+	// RoundRobin use the folders one after the other.
+	RoundRobin Placement = iota
+	// FreeSpace use the folder with the most space left, considering both the disk and the quota.
+	FreeSpace
+)
+
+// placer Spread the chunks of a job across its folders.
+// A folder is skipped if the chunk does not fit in its quota, and an error is returned
+// if the chunk fits in none of them.
+type placer struct {
+	mu     *sync.Mutex
+	dirs   []ChunkDir
+	used   []int64
+	policy Placement
+	next   int
+}
+
+func newPlacer(dirs []ChunkDir, policy Placement) *placer {
+	return &placer{
+		mu:     &sync.Mutex{},
+		dirs:   dirs,
+		used:   make([]int64, len(dirs)),
+		policy: policy,
+	}
+}
+
+// reserve Pick a folder for a chunk of size bytes and account for it in the quota.
+// It returns the index of the folder.
+func (p *placer) reserve(size int64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, bestSpace := -1, int64(-1)
+	for i := range p.dirs {
+		idx := (p.next + i) % len(p.dirs)
+		space := p.space(idx)
+		if space < size {
+			continue
+		}
+		if p.policy == RoundRobin {
+			best = idx
+			break
+		}
+		if space > bestSpace {
+			best, bestSpace = idx, space
+		}
+	}
+	if best < 0 {
+		return 0, errors.Errorf("no chunk folder has room for a chunk of %d bytes", size)
+	}
+	p.used[best] += size
+	p.next = best + 1
+	return best, nil
+}
+
+// release Give back the size of a removed chunk to the quota of its folder.
+func (p *placer) release(idx int, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used[idx] -= size
+}
+
+// space returns the number of bytes that can still be written in a folder.
+func (p *placer) space(idx int) int64 {
+	space := int64(-1)
+	if p.dirs[idx].Quota > 0 {
+		space = p.dirs[idx].Quota - p.used[idx]
+	}
+	if p.policy != FreeSpace {
+		if space < 0 {
+			return math.MaxInt64
+		}
+		return space
+	}
+	free, err := freeSpace(p.dirs[idx].Path)
+	if err != nil {
+		return 0
+	}
+	if space < 0 || free < space {
+		return free
+	}
+	return space
+}
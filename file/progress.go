@@ -0,0 +1,156 @@
+package file
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// Phase A step of the sort.
+type Phase string
+
+const (
+	// PhaseChunking the input is scanned and split in sorted chunks. Progress is counted in bytes read.
+	PhaseChunking Phase = "chunking"
+	// PhaseMerge the chunks are merged into the output. Progress is counted in rows written.
+	PhaseMerge Phase = "merge"
+)
+
+// ProgressReporter Receive the progress of every phase of a sort.
+// Advance can be called from several goroutines at the same time.
+type ProgressReporter interface {
+	// Start a phase of total units. total is 0 when it is unknown.
+	Start(phase Phase, total int64)
+	// Advance the phase by n units.
+	Advance(phase Phase, n int64)
+	// Finish the phase.
+	Finish(phase Phase)
+}
+
+// NoProgress Ignore the progress.
+type NoProgress struct{}
+
+func (NoProgress) Start(Phase, int64)   {}
+func (NoProgress) Advance(Phase, int64) {}
+func (NoProgress) Finish(Phase)         {}
+
+// barReporter Display a progress bar in the terminal for every phase.
+type barReporter struct {
+	mu  sync.Mutex
+	bar *pb.ProgressBar
+}
+
+// NewBarReporter returns a reporter drawing a progress bar on the standard error.
+func NewBarReporter() ProgressReporter {
+	return &barReporter{}
+}
+
+func (r *barReporter) Start(phase Phase, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bar = pb.New64(total)
+	r.bar.Set(pb.Bytes, phase == PhaseChunking)
+	r.bar.Set("prefix", string(phase)+" ")
+	r.bar.SetWriter(os.Stderr)
+	r.bar.Start()
+}
+
+func (r *barReporter) Advance(phase Phase, n int64) {
+	r.mu.Lock()
+	bar := r.bar
+	r.mu.Unlock()
+	if bar != nil {
+		bar.Add64(n)
+	}
+}
+
+func (r *barReporter) Finish(phase Phase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.bar != nil {
+		r.bar.Finish()
+		r.bar = nil
+	}
+}
+
+// logReporter Log the progress of the current phase at a regular interval.
+type logReporter struct {
+	logger   *log.Logger
+	interval time.Duration
+	mu       sync.Mutex
+	total    int64
+	current  int64
+	started  time.Time
+	logged   time.Time
+}
+
+// NewLogReporter returns a reporter logging the progress as key=value pairs at most once per interval.
+func NewLogReporter(logger *log.Logger, interval time.Duration) ProgressReporter {
+	return &logReporter{logger: logger, interval: interval}
+}
+
+func (r *logReporter) Start(phase Phase, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total, r.current = total, 0
+	r.started = time.Now()
+	r.logged = r.started
+	r.logger.Printf("phase=%s event=start total=%d", phase, total)
+}
+
+func (r *logReporter) Advance(phase Phase, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current += n
+	now := time.Now()
+	if now.Sub(r.logged) < r.interval {
+		return
+	}
+	r.logged = now
+	percent := 0.0
+	if r.total > 0 {
+		percent = 100 * float64(r.current) / float64(r.total)
+	}
+	r.logger.Printf("phase=%s event=progress current=%d total=%d percent=%.1f", phase, r.current, r.total, percent)
+}
+
+func (r *logReporter) Finish(phase Phase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger.Printf("phase=%s event=finish current=%d elapsed=%.3fs", phase, r.current, time.Since(r.started).Seconds())
+}
+
+// progress returns the reporter of the sort.
+func (f *Info) progress() ProgressReporter {
+	if f.Progress == nil {
+		return NoProgress{}
+	}
+	return f.Progress
+}
+
+// inputSize returns the size of a file input, or 0 if it is unknown.
+func (f *Info) inputSize() int64 {
+	if len(f.Inputs) > 0 {
+		size := int64(0)
+		for _, input := range f.Inputs {
+			size += input.Size
+		}
+		return size
+	}
+	if f.InputPath != "" {
+		stat, err := os.Stat(f.InputPath)
+		if err == nil {
+			return stat.Size()
+		}
+	}
+	if file, ok := f.Reader.(interface{ Stat() (os.FileInfo, error) }); ok {
+		stat, err := file.Stat()
+		if err == nil && stat.Mode().IsRegular() {
+			return stat.Size()
+		}
+	}
+	return 0
+}
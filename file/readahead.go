@@ -0,0 +1,121 @@
+package file
+
+import (
+	"github.com/askiada/external-sort/vector"
+	"golang.org/x/sync/semaphore"
+)
+
+// rowOverhead approximate number of bytes used by a row in memory on top of its content.
+const rowOverhead = 64
+
+// readAhead Read the next rows of a chunk in the background while the current ones are merged.
+// Each batch read in advance reserves its estimated size from the memory budget until it is replaced.
+// When the budget is exhausted, the next batch is only read once the merge asks for it.
+type readAhead struct {
+	budget  *semaphore.Weighted
+	next    chan *batch
+	demand  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	// reserved bytes reserved by the batch currently merged.
+	reserved int64
+}
+
+// batch Rows read in advance from a chunk.
+type batch struct {
+	buffer   vector.Vector
+	err      error
+	reserved int64
+}
+
+// startReadAhead Start reading the next batches of the chunk in the background.
+// budget can be nil if the memory is not limited.
+func (c *chunkInfo) startReadAhead(allocate *vector.Allocate, size int, budget *semaphore.Weighted) {
+	c.readAhead = &readAhead{
+		budget:  budget,
+		next:    make(chan *batch),
+		demand:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	// the next batch is expected to be as big as the previous one
+	go c.readBatches(allocate, size, bufferBytes(c.buffer))
+}
+
+// readBatches Read batches of size rows until the end of the chunk.
+// estimate is the expected memory used by the next batch.
+func (c *chunkInfo) readBatches(allocate *vector.Allocate, size int, estimate int64) {
+	ra := c.readAhead
+	defer close(ra.stopped)
+	for {
+		reserved := int64(0)
+		switch {
+		case ra.budget == nil:
+		case ra.budget.TryAcquire(estimate):
+			reserved = estimate
+		default:
+			select {
+			case <-ra.demand:
+			case <-ra.done:
+				return
+			}
+		}
+		b := &batch{
+			buffer:   allocate.Vector(size, allocate.Key),
+			reserved: reserved,
+		}
+		b.err = c.pull(b.buffer, size)
+		// the buffer belongs to the merge once sent
+		last := b.err != nil || b.buffer.Len() == 0
+		estimate = bufferBytes(b.buffer)
+		select {
+		case ra.next <- b:
+		case <-ra.done:
+			ra.release(reserved)
+			return
+		}
+		if last {
+			return
+		}
+	}
+}
+
+// take Wait for the next batch and release the memory of the previous one.
+func (ra *readAhead) take() *batch {
+	select {
+	case ra.demand <- struct{}{}:
+	default:
+	}
+	b := <-ra.next
+	// the demand is not needed anymore if the batch was read within the budget
+	select {
+	case <-ra.demand:
+	default:
+	}
+	ra.release(ra.reserved)
+	ra.reserved = b.reserved
+	return b
+}
+
+// stop Stop reading in the background and release the memory reserved.
+func (ra *readAhead) stop() {
+	close(ra.done)
+	<-ra.stopped
+	ra.release(ra.reserved)
+	ra.reserved = 0
+}
+
+func (ra *readAhead) release(n int64) {
+	if ra.budget != nil && n > 0 {
+		ra.budget.Release(n)
+	}
+}
+
+// bufferBytes Estimate the memory used by the rows of a vector.
+func bufferBytes(v vector.Vector) int64 {
+	size := int64(0)
+	for i := 0; i < v.Len(); i++ {
+		size += int64(len(v.Get(i).Line)) + rowOverhead
+	}
+	return size
+}
@@ -0,0 +1,326 @@
+package file
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/askiada/external-sort/vector"
+	"github.com/askiada/external-sort/vector/key"
+
+	"github.com/pkg/errors"
+)
+
+// Reducer Collapse the rows with equal keys into a single row.
+// Rows are first turned into partial results by Init, then partial results with equal keys
+// are combined by Merge, in any grouping. The key of a partial result must be the key of its rows.
+type Reducer interface {
+	// Init returns the partial result of a single row.
+	Init(line string) (string, error)
+	// Merge returns the partial result combining a and b, a coming first.
+	Merge(a, b string) (string, error)
+}
+
+var (
+	_ Reducer = Count{}
+	_ Reducer = Sum{}
+	_ Reducer = Min{}
+	_ Reducer = Max{}
+	_ Reducer = First{}
+	_ Reducer = Last{}
+	_ Reducer = ConcatDistinct{}
+)
+
+// Count Keep the first row of every key followed by the number of rows as a last tab separated column.
+type Count struct{}
+
+func (Count) Init(line string) (string, error) {
+	return line + "\t1", nil
+}
+
+func (Count) Merge(a, b string) (string, error) {
+	i := strings.LastIndexByte(a, '\t')
+	j := strings.LastIndexByte(b, '\t')
+	if i < 0 || j < 0 {
+		return "", errors.New("count: missing count column")
+	}
+	countA, err := strconv.ParseInt(a[i+1:], 10, 64)
+	if err != nil {
+		return "", errors.Wrap(err, "count")
+	}
+	countB, err := strconv.ParseInt(b[j+1:], 10, 64)
+	if err != nil {
+		return "", errors.Wrap(err, "count")
+	}
+	return a[:i+1] + strconv.FormatInt(countA+countB, 10), nil
+}
+
+// Sum Keep the first row of every key with the sum of the numeric tab separated column Column.
+type Sum struct {
+	Column int
+}
+
+func (s Sum) Init(line string) (string, error) {
+	return line, checkNumber(line, s.Column)
+}
+
+func (s Sum) Merge(a, b string) (string, error) {
+	return mergeNumbers(a, b, s.Column, func(x, y int64) (int64, bool) {
+		sum := x + y
+		// integers are summed as floats when the sum overflows
+		return sum, (sum > x) == (y > 0)
+	}, func(x, y float64) float64 { return x + y })
+}
+
+// Min Keep the first row of every key with the smallest value of the numeric tab separated column Column.
+type Min struct {
+	Column int
+}
+
+func (m Min) Init(line string) (string, error) {
+	return line, checkNumber(line, m.Column)
+}
+
+func (m Min) Merge(a, b string) (string, error) {
+	return mergeNumbers(a, b, m.Column, func(x, y int64) (int64, bool) {
+		if y < x {
+			return y, true
+		}
+		return x, true
+	}, func(x, y float64) float64 {
+		if y < x {
+			return y
+		}
+		return x
+	})
+}
+
+// Max Keep the first row of every key with the largest value of the numeric tab separated column Column.
+type Max struct {
+	Column int
+}
+
+func (m Max) Init(line string) (string, error) {
+	return line, checkNumber(line, m.Column)
+}
+
+func (m Max) Merge(a, b string) (string, error) {
+	return mergeNumbers(a, b, m.Column, func(x, y int64) (int64, bool) {
+		if y > x {
+			return y, true
+		}
+		return x, true
+	}, func(x, y float64) float64 {
+		if y > x {
+			return y
+		}
+		return x
+	})
+}
+
+// First Keep the first row of every key in the order of the input.
+type First struct{}
+
+func (First) Init(line string) (string, error) {
+	return line, nil
+}
+
+func (First) Merge(a, b string) (string, error) {
+	return a, nil
+}
+
+// Last Keep the last row of every key in the order of the input.
+type Last struct{}
+
+func (Last) Init(line string) (string, error) {
+	return line, nil
+}
+
+func (Last) Merge(a, b string) (string, error) {
+	return b, nil
+}
+
+// ConcatDistinct Keep the first row of every key with the distinct values of the tab separated column Column,
+// sorted and joined by Sep.
+type ConcatDistinct struct {
+	Column int
+	Sep    string
+}
+
+func (c ConcatDistinct) Init(line string) (string, error) {
+	_, err := column(line, c.Column)
+	return line, err
+}
+
+func (c ConcatDistinct) Merge(a, b string) (string, error) {
+	columnsA := strings.Split(a, "\t")
+	columnB, err := column(b, c.Column)
+	if err != nil {
+		return "", err
+	}
+	if c.Column >= len(columnsA) {
+		return "", errors.Errorf("missing column %d", c.Column)
+	}
+	values := append(strings.Split(columnsA[c.Column], c.Sep), strings.Split(columnB, c.Sep)...)
+	sort.Strings(values)
+	distinct := values[:1]
+	for _, value := range values[1:] {
+		if value != distinct[len(distinct)-1] {
+			distinct = append(distinct, value)
+		}
+	}
+	columnsA[c.Column] = strings.Join(distinct, c.Sep)
+	return strings.Join(columnsA, "\t"), nil
+}
+
+// column returns the tab separated column pos of line.
+func column(line string, pos int) (string, error) {
+	columns := strings.Split(line, "\t")
+	if pos >= len(columns) {
+		return "", errors.Errorf("missing column %d", pos)
+	}
+	return columns[pos], nil
+}
+
+// checkNumber returns an error if the tab separated column pos of line is not a number.
+func checkNumber(line string, pos int) error {
+	value, err := column(line, pos)
+	if err != nil {
+		return err
+	}
+	_, err = strconv.ParseFloat(value, 64)
+	return err
+}
+
+// mergeNumbers returns a with the numeric column pos replaced by the merge of the columns of a and b.
+// Integers are merged by mergeInt, unless it returns false, so they do not lose precision.
+// Other numbers are merged by mergeFloat.
+func mergeNumbers(a, b string, pos int, mergeInt func(x, y int64) (int64, bool), mergeFloat func(x, y float64) float64) (string, error) {
+	columnsA := strings.Split(a, "\t")
+	if pos >= len(columnsA) {
+		return "", errors.Errorf("missing column %d", pos)
+	}
+	value, err := column(b, pos)
+	if err != nil {
+		return "", err
+	}
+	i, errA := strconv.ParseInt(columnsA[pos], 10, 64)
+	j, errB := strconv.ParseInt(value, 10, 64)
+	if errA == nil && errB == nil {
+		if merged, ok := mergeInt(i, j); ok {
+			columnsA[pos] = strconv.FormatInt(merged, 10)
+			return strings.Join(columnsA, "\t"), nil
+		}
+	}
+	x, err := strconv.ParseFloat(columnsA[pos], 64)
+	if err != nil {
+		return "", err
+	}
+	y, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", err
+	}
+	columnsA[pos] = strconv.FormatFloat(mergeFloat(x, y), 'f', -1, 64)
+	return strings.Join(columnsA, "\t"), nil
+}
+
+// equalKeys returns whether a and b have the same key.
+func equalKeys(a, b key.Key) bool {
+	return !a.Less(b) && !b.Less(a)
+}
+
+// reduceWriter Collapse the consecutive rows with equal keys before they are written to w.
+// The last row is held until the next key starts or the rows are flushed.
+type reduceWriter struct {
+	w       rowWriter
+	reduce  Reducer
+	pending *vector.Element
+	reduced vector.Vector
+}
+
+// newReduceWriter returns a writer reducing the rows written to w with Reduce, k rows at a time.
+func (f *Info) newReduceWriter(w rowWriter, k int) *reduceWriter {
+	return &reduceWriter{
+		w:       w,
+		reduce:  f.Reduce,
+		reduced: f.Allocate.Vector(k, f.Allocate.Key),
+	}
+}
+
+func (rw *reduceWriter) writeRows(rows vector.Vector) error {
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Get(i)
+		if rw.pending == nil {
+			rw.pending = &vector.Element{Line: row.Line, Key: row.Key}
+			continue
+		}
+		if equalKeys(rw.pending.Key, row.Key) {
+			line, err := rw.reduce.Merge(rw.pending.Line, row.Line)
+			if err != nil {
+				return err
+			}
+			rw.pending.Line = line
+			continue
+		}
+		err := rw.reduced.PushBack(rw.pending.Line)
+		if err != nil {
+			return err
+		}
+		rw.pending = &vector.Element{Line: row.Line, Key: row.Key}
+	}
+	rows.Reset()
+	if rw.reduced.Len() == 0 {
+		return nil
+	}
+	return rw.w.writeRows(rw.reduced)
+}
+
+func (rw *reduceWriter) flush() error {
+	if rw.pending != nil {
+		err := rw.reduced.PushBack(rw.pending.Line)
+		if err != nil {
+			return err
+		}
+		rw.pending = nil
+		err = rw.w.writeRows(rw.reduced)
+		if err != nil {
+			return err
+		}
+	}
+	return rw.w.flush()
+}
+
+// combine returns the sorted rows of v with the rows of equal keys collapsed by Reduce.
+func (f *Info) combine(v vector.Vector) (vector.Vector, error) {
+	combined := f.Allocate.Vector(v.Len(), f.Allocate.Key)
+	rw := f.newReduceWriter(vectorWriter{combined}, v.Len())
+	err := rw.writeRows(v)
+	if err != nil {
+		return nil, err
+	}
+	err = rw.flush()
+	if err != nil {
+		return nil, err
+	}
+	return combined, nil
+}
+
+// vectorWriter Append the rows to a vector.
+type vectorWriter struct {
+	v vector.Vector
+}
+
+func (vw vectorWriter) writeRows(rows vector.Vector) error {
+	for i := 0; i < rows.Len(); i++ {
+		err := vw.v.PushBack(rows.Get(i).Line)
+		if err != nil {
+			return err
+		}
+	}
+	rows.Reset()
+	return nil
+}
+
+func (vw vectorWriter) flush() error {
+	return nil
+}
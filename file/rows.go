@@ -0,0 +1,224 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/askiada/external-sort/file/batchingchannels"
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/vector"
+
+	"github.com/pkg/errors"
+)
+
+// RowPolicy What happens to an input row whose key can not be allocated.
+type RowPolicy int
+
+const (
+	// FailOnBadRow stop the sort at the first bad row.
+	FailOnBadRow RowPolicy = iota
+	// SkipBadRows drop the bad rows.
+	SkipBadRows
+	// QuarantineBadRows drop the bad rows and write them to QuarantinePath.
+	QuarantineBadRows
+)
+
+// RowError An input row whose key can not be allocated.
+type RowError struct {
+	Err  error
+	Text string
+	// Source name of the input of the row, empty if there is a single unnamed input.
+	Source string
+	// Line number of the row in the input, starting at 1.
+	Line int
+	// Offset position in bytes of the row in the input.
+	Offset int64
+}
+
+func (e *RowError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("input %s: line %d (byte %d): %v", e.Source, e.Line, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("line %d (byte %d): %v", e.Line, e.Offset, e.Err)
+}
+
+// Cause returns the error returned by the key allocation.
+func (e *RowError) Cause() error {
+	return e.Err
+}
+
+// badRows Apply the row policy and count the bad rows.
+// The quarantine file is only created once the first bad row is found.
+type badRows struct {
+	mu         sync.Mutex
+	policy     RowPolicy
+	maxErrors  int
+	path       string
+	count      int
+	file       *os.File
+	quarantine *bufio.Writer
+	// framing delimit the rows of the quarantine file like the rows of the input.
+	framing framing.Framing
+}
+
+// add Handle a bad row. It returns an error if the sort must stop.
+func (b *badRows) add(rowErr *RowError) error {
+	if b.policy == FailOnBadRow {
+		return rowErr
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.count++
+	if b.maxErrors > 0 && b.count > b.maxErrors {
+		return errors.Wrapf(rowErr, "more than %d bad rows", b.maxErrors)
+	}
+	if b.policy != QuarantineBadRows {
+		return nil
+	}
+	if b.file == nil {
+		f, err := os.Create(b.path)
+		if err != nil {
+			return errors.Wrap(err, "quarantine")
+		}
+		b.file = f
+		b.quarantine = bufio.NewWriter(f)
+	}
+	framed, err := b.framing.Append(nil, rowErr.Text)
+	if err != nil {
+		return errors.Wrap(err, "quarantine")
+	}
+	_, err = b.quarantine.Write(framed)
+	return errors.Wrap(err, "quarantine")
+}
+
+// close Flush and close the quarantine file.
+func (b *badRows) close() error {
+	if b.file == nil {
+		return nil
+	}
+	err := b.quarantine.Flush()
+	cerr := b.file.Close()
+	b.file = nil
+	if err == nil {
+		err = cerr
+	}
+	return errors.Wrap(err, "quarantine")
+}
+
+// BadRows returns the number of input rows dropped by the row policy.
+func (f *Info) BadRows() int {
+	if f.badRows == nil {
+		return 0
+	}
+	f.badRows.mu.Lock()
+	defer f.badRows.mu.Unlock()
+	return f.badRows.count
+}
+
+// allocateRows Add the rows of a block to v. Bad rows are handled by the row policy.
+func (f *Info) allocateRows(v vector.Vector, b batchingchannels.Block) error {
+	i := 0
+	for _, span := range b.RowSpans() {
+		for j := 0; j < span.Len; j, i = j+1, i+1 {
+			text := b.Lines[i]
+			var err error
+			if f.Reduce != nil {
+				// rows are sorted and merged as partial results
+				text, err = f.Reduce.Init(text)
+			}
+			if err == nil {
+				err = v.PushBack(text)
+			}
+			if err == nil {
+				continue
+			}
+			// the input row is reported, not its partial result
+			rowErr := &RowError{Err: err, Text: b.Lines[i], Source: span.Source, Line: span.Line + j}
+			if b.Offsets != nil {
+				rowErr.Offset = b.Offsets[i]
+			}
+			err = f.badRows.add(rowErr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// progressBytes number of bytes read between two reports of the chunking progress.
+const progressBytes = 1 << 20
+
+// lineScanner Scan the rows of the input delimited by a framing and keep track of their position.
+// The bytes read are reported to progress and the rows to metrics.
+type lineScanner struct {
+	*bufio.Scanner
+	progress ProgressReporter
+	metrics  Metrics
+	// source name of the input.
+	source string
+	closer io.Closer
+	// suffix added to every row, the source column.
+	suffix string
+	// line number of the current row, starting at 1.
+	line int
+	// offset position in bytes of the current row.
+	offset       int64
+	next         int64
+	reported     int64
+	reportedLine int
+}
+
+func newLineScanner(r io.Reader, frame framing.Framing, maxRecordSize int, progress ProgressReporter, metrics Metrics) *lineScanner {
+	s := &lineScanner{Scanner: framing.NewScanner(r, frame, maxRecordSize), progress: progress, metrics: metrics}
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := frame.Split(data, atEOF)
+		if token != nil {
+			s.line++
+			s.offset = s.next
+		}
+		s.next += int64(advance)
+		if s.next-s.reported >= progressBytes {
+			s.flush()
+		}
+		return advance, token, err
+	})
+	return s
+}
+
+// Text returns the current row, followed by the source column if it is set.
+func (s *lineScanner) Text() string {
+	return s.Scanner.Text() + s.suffix
+}
+
+// close Report the last rows read and close the input.
+// It returns the error of the scan, naming the input and the line.
+func (s *lineScanner) close() error {
+	s.flush()
+	err := s.Err()
+	if err != nil {
+		err = errors.Wrapf(err, "line %d", s.line+1)
+		if s.source != "" {
+			err = errors.Wrapf(err, "input %s", s.source)
+		}
+	}
+	if s.closer != nil {
+		cerr := s.closer.Close()
+		s.closer = nil
+		if err == nil && cerr != nil {
+			err = errors.Wrapf(cerr, "input %s", s.source)
+		}
+	}
+	return err
+}
+
+// flush Report the bytes and the rows read since the last report.
+func (s *lineScanner) flush() {
+	s.progress.Advance(PhaseChunking, s.next-s.reported)
+	s.metrics.AddRowsScanned(int64(s.line - s.reportedLine))
+	s.reported = s.next
+	s.reportedLine = s.line
+}
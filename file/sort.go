@@ -2,23 +2,53 @@ package file
 
 import (
 	"bufio"
-	"fmt"
-	"os"
+	"context"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/askiada/external-sort/file/framing"
 	"github.com/askiada/external-sort/vector"
-	"github.com/cheggaaa/pb/v3"
+	"golang.org/x/sync/semaphore"
 )
 
+// MemUsage Peak memory usage of a sort, reported by Stats.
 type MemUsage struct {
+	// calls number of rows seen by collectMemUsage, first to be aligned for atomic operations.
+	calls    uint64
 	MaxAlloc uint64
 	MaxSys   uint64
 	NumGc    uint32
+	// lock ranges merged in parallel collect the memory usage at the same time.
+	lock sync.Mutex
 }
 
-func (mu *MemUsage) Collect() {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
+// memSampleRows number of rows between two reads of the memory usage, reading it stops the world.
+const memSampleRows = 1024
+
+// collectsMemUsage returns true if the memory usage is sampled, for the report or the metrics.
+func (f *Info) collectsMemUsage() bool {
+	return f.PrintMemUsage || f.Metrics != nil
+}
+
+// collectMemUsage Sample the memory usage if PrintMemUsage or Metrics is set.
+func (f *Info) collectMemUsage() {
+	if !f.collectsMemUsage() {
+		return
+	}
+	if atomic.AddUint64(&f.mu.calls, 1)%memSampleRows == 1 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		f.mu.update(&m)
+		f.metrics().SetMemUsage(m.Alloc, m.Sys)
+	}
+}
+
+// update Keep the peak memory usage.
+func (mu *MemUsage) update(m *runtime.MemStats) {
+	mu.lock.Lock()
+	defer mu.lock.Unlock()
 	if m.Alloc > mu.MaxAlloc {
 		mu.MaxAlloc = m.Alloc
 	}
@@ -29,52 +59,165 @@ func (mu *MemUsage) Collect() {
 	mu.NumGc = m.NumGC
 }
 
-func (mu *MemUsage) PrintMemUsage() {
-	fmt.Printf("Max Alloc = %v MiB", bToMb(mu.MaxAlloc))
-	fmt.Printf("\tMax Sys = %v MiB", bToMb(mu.MaxSys))
-	fmt.Printf("\tNumGC = %v\n", mu.NumGc)
-}
-
-func bToMb(b uint64) uint64 {
-	return b / 1024 / 1024
-}
-
-func (f *Info) MergeSort(chunkPaths []string, k int) (err error) {
-	output := f.Allocate.Vector(k, f.Allocate.Key)
-	if f.PrintMemUsage && f.mu == nil {
+// MergeSort Merge all the sorted chunks into the output using a buffer of k rows per chunk.
+// If CreateSortedChunks sorted the input in memory, the rows are written directly.
+// With MergeWorkers greater than 1, ranges of keys are merged in parallel when they can be written
+// straight into the output, see mergesInParallel.
+// The job folder created by CreateSortedChunks is removed once done, even if the merge fails
+// unless it can be resumed.
+func (f *Info) MergeSort(ctx context.Context, chunkPaths []string, k int) (err error) {
+	if f.runStats == nil {
+		f.runStats = newStats(f.KeySpec)
+	}
+	start := time.Now()
+	defer func() {
+		f.runStats.update(func(report *Stats) {
+			report.Durations.Merge = time.Since(start).Seconds()
+			report.Durations.Total = time.Since(f.runStats.started).Seconds()
+		})
+		if err != nil {
+			f.release()
+			return
+		}
+		err = f.Cleanup()
+	}()
+	if f.collectsMemUsage() && f.mu == nil {
 		f.mu = &MemUsage{}
 	}
+	if f.memory != nil {
+		return f.writeMemory(ctx)
+	}
+	// the output of a parallel merge is opened first, to know if it can be written at an offset
+	var output AtomicWriter
+	if f.mergesInParallel(chunkPaths) {
+		output, err = f.openOutput()
+		if err != nil {
+			return err
+		}
+		if canWriteAt(output) {
+			return f.parallelMergeSort(ctx, chunkPaths, k, output)
+		}
+		defer func() {
+			if err != nil {
+				output.Abort()
+			}
+		}()
+	}
 	// create a chunk per file path
-	chunks := &chunks{list: make([]*chunkInfo, 0, len(chunkPaths))}
-	for _, chunkPath := range chunkPaths {
-		err := chunks.new(chunkPath, f.Allocate, k)
+	chunks := &chunks{
+		list:      make([]*chunkInfo, 0, len(chunkPaths)),
+		keepFiles: f.job != nil && f.job.resumable,
+		metrics:   f.metrics(),
+	}
+	err = chunks.open(wholeChunks(chunkPaths), f.Allocate, k)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			chunks.close()
+		}
+	}()
+	if f.ReadAhead {
+		chunks.startReadAhead(f.Allocate, k, f.newBudget())
+	}
+
+	var w rowWriter
+	var outputFile committer = output
+	if output != nil {
+		w = f.newTextWriter(output)
+	} else {
+		w, outputFile, err = f.openRowOutput(f.chunkSplitters(chunkPaths))
 		if err != nil {
 			return err
 		}
 	}
+	// the output is only published if everything succeeded
+	defer func() {
+		if err != nil {
+			outputFile.Abort()
+		}
+	}()
 
-	outputFile, err := os.Create(f.OutputPath)
+	f.progress().Start(PhaseMerge, int64(f.outputRows()))
+	err = f.merge(ctx, chunks, k, w, f.progress())
 	if err != nil {
 		return err
 	}
-	// remember to close the file
-	defer outputFile.Close()
+	f.progress().Finish(PhaseMerge)
+	err = chunks.close()
+	if err != nil {
+		return err
+	}
+	return outputFile.Commit()
+}
+
+// openOutput Create the destination of the sorted rows.
+func (f *Info) openOutput() (AtomicWriter, error) {
+	return f.openPath(f.OutputPath)
+}
+
+// openPath Create an output at outputPath with OpenOutput.
+func (f *Info) openPath(outputPath string) (AtomicWriter, error) {
+	openOutput := f.OpenOutput
+	if openOutput == nil {
+		openOutput = CreateAtomicFile
+	}
+	output, err := openOutput(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	return countingOutput{AtomicWriter: output, stats: f.runStats}, nil
+}
+
+// newBudget returns the semaphore limiting the memory used by the read-ahead, or nil if there is no limit.
+func (f *Info) newBudget() *semaphore.Weighted {
+	if f.MemoryBudget <= 0 {
+		return nil
+	}
+	return semaphore.NewWeighted(f.MemoryBudget)
+}
+
+// outputRows returns the number of rows written to the output.
+func (f *Info) outputRows() int {
+	if f.Limit > 0 && f.Limit < f.totalRows {
+		return f.Limit
+	}
+	return f.totalRows
+}
 
-	outputBuffer := bufio.NewWriter(outputFile)
+// merge Write the rows of all the chunks to w in ascending order and report them to progress.
+// It stops after Limit rows if Limit is set.
+func (f *Info) merge(ctx context.Context, chunks *chunks, k int, w rowWriter, progress ProgressReporter) (err error) {
+	if f.Reduce != nil {
+		w = f.newReduceWriter(w, k)
+	}
+	output := f.Allocate.Vector(k, f.Allocate.Key)
+	// rows are written in the background while the next ones are merged
+	writer := newBackgroundWriter(w, f.Allocate.Vector(k, f.Allocate.Key))
+	defer func() {
+		if err != nil {
+			writer.close()
+		}
+	}()
 
-	bar := pb.StartNew(f.totalRows)
 	chunks.resetOrder()
+	written := 0
 	for {
-		if f.PrintMemUsage {
-			f.mu.Collect()
-		}
-		if chunks.len() == 0 || output.Len() == k {
-			err = WriteBuffer(outputBuffer, output)
+		f.collectMemUsage()
+		done := chunks.len() == 0 || (f.Limit > 0 && written == f.Limit)
+		if done || output.Len() == k {
+			err = ctx.Err()
+			if err != nil {
+				return err
+			}
+			progress.Advance(PhaseMerge, int64(output.Len()))
+			output, err = writer.write(output)
 			if err != nil {
 				return err
 			}
 		}
-		if chunks.len() == 0 {
+		if done {
 			break
 		}
 		toShrink := []int{}
@@ -106,22 +249,21 @@ func (f *Info) MergeSort(chunkPaths []string, k int) (err error) {
 		if !isEmpty {
 			chunks.moveFirstChunkToCorrectIndex()
 		}
-		bar.Increment()
-	}
-	err = outputBuffer.Flush()
-	if err != nil {
-		return err
+		written++
 	}
-	bar.Finish()
-	if f.PrintMemUsage {
-		f.mu.PrintMemUsage()
-	}
-	return chunks.close()
+	return writer.close()
 }
 
-func WriteBuffer(buffer *bufio.Writer, rows vector.Vector) error {
+// writeFramed Write the rows delimited by frame and reset the vector.
+func writeFramed(buffer *bufio.Writer, rows vector.Vector, frame framing.Framing) error {
+	framed := []byte{}
 	for i := 0; i < rows.Len(); i++ {
-		_, err := buffer.WriteString(rows.Get(i).Line + "\n")
+		var err error
+		framed, err = frame.Append(framed[:0], rows.Get(i).Line)
+		if err != nil {
+			return err
+		}
+		_, err = buffer.Write(framed)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,384 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/vector"
+	"github.com/askiada/external-sort/vector/key"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultChunkRows number of rows of a chunk when WithChunkSize is not used.
+	defaultChunkRows = 1 << 16
+	// defaultBufferRows number of rows buffered per chunk during the merge when WithBufferSize is not used.
+	defaultBufferRows = 1024
+)
+
+// Sorter Sort a stream of rows in a single call.
+// It runs CreateSortedChunks and MergeSort on a new Info for every sort,
+// so a Sorter can be used by several goroutines at the same time.
+type Sorter struct {
+	allocateKey  func(line string) (key.Key, error)
+	chunkRows    int
+	bufferRows   int
+	memoryBudget int64
+	inMemorySize int64
+	// maxRecordSize maximum number of bytes of a row, 0 uses framing.DefaultMaxRecordSize.
+	maxRecordSize int
+	// groupRows rows of a key held in memory by a join or a diff, 0 uses defaultGroupRows.
+	groupRows    int
+	workers      int64
+	mergeWorkers int
+	tempDirs     []ChunkDir
+	inputCodec   Codec
+	outputCodec  Codec
+	progress     ProgressReporter
+	metrics      Metrics
+	framing      framing.Framing
+	reduce       Reducer
+	combine      bool
+}
+
+// Option Change a setting of a Sorter.
+type Option func(s *Sorter)
+
+// WithKey Sort the rows by the key returned by allocateKey. Rows are sorted by their whole text by default.
+func WithKey(allocateKey func(line string) (key.Key, error)) Option {
+	return func(s *Sorter) {
+		s.allocateKey = allocateKey
+	}
+}
+
+// WithChunkSize Hold at most rows rows in memory per chunk.
+func WithChunkSize(rows int) Option {
+	return func(s *Sorter) {
+		s.chunkRows = rows
+	}
+}
+
+// WithBufferSize Buffer rows rows of every chunk during the merge.
+func WithBufferSize(rows int) Option {
+	return func(s *Sorter) {
+		s.bufferRows = rows
+	}
+}
+
+// WithMemoryBudget Limit to bytes the rows read ahead during the merge.
+func WithMemoryBudget(bytes int64) Option {
+	return func(s *Sorter) {
+		s.memoryBudget = bytes
+	}
+}
+
+// WithMaxRecordSize Read rows of up to bytes. framing.DefaultMaxRecordSize is used by default.
+func WithMaxRecordSize(bytes int) Option {
+	return func(s *Sorter) {
+		s.maxRecordSize = bytes
+	}
+}
+
+// WithGroupRows Hold in memory up to rows rows of a key in a join or a diff, the others are spilled
+// to the first temporary folder. Join.GroupRows takes precedence for a join.
+func WithGroupRows(rows int) Option {
+	return func(s *Sorter) {
+		s.groupRows = rows
+	}
+}
+
+// WithInMemorySize Sort in memory the inputs of at most bytes, even when they hold more rows than a chunk.
+func WithInMemorySize(bytes int64) Option {
+	return func(s *Sorter) {
+		s.inMemorySize = bytes
+	}
+}
+
+// WithWorkers Sort and write up to workers chunks at the same time, and merge mergeWorkers key ranges in parallel.
+// Key ranges are only merged in parallel into an output created by CreateAtomicFile, or any AtomicWriter
+// that is an io.WriterAt, without output codec. The rows of any other stream are merged at once.
+func WithWorkers(workers int64, mergeWorkers int) Option {
+	return func(s *Sorter) {
+		s.workers = workers
+		s.mergeWorkers = mergeWorkers
+	}
+}
+
+// WithTempDirs Write the chunks in dirs. The system temporary folder is used by default, or if dirs is empty.
+func WithTempDirs(dirs ...ChunkDir) Option {
+	return func(s *Sorter) {
+		if len(dirs) == 0 {
+			dirs = ChunkDirs(os.TempDir())
+		}
+		s.tempDirs = dirs
+	}
+}
+
+// WithInputCodec Decode the input with codec.
+func WithInputCodec(codec Codec) Option {
+	return func(s *Sorter) {
+		s.inputCodec = codec
+	}
+}
+
+// WithOutputCodec Encode the output with codec.
+func WithOutputCodec(codec Codec) Option {
+	return func(s *Sorter) {
+		s.outputCodec = codec
+	}
+}
+
+// WithFraming Delimit the rows of the input and the output with frame instead of newlines.
+func WithFraming(frame framing.Framing) Option {
+	return func(s *Sorter) {
+		s.framing = frame
+	}
+}
+
+// WithReporter Report the progress of every sort to progress.
+func WithReporter(progress ProgressReporter) Option {
+	return func(s *Sorter) {
+		s.progress = progress
+	}
+}
+
+// WithMetrics Feed the measures of every sort to metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(s *Sorter) {
+		s.metrics = metrics
+	}
+}
+
+// WithReducer Collapse the rows with equal keys with reduce, also within every chunk if combine is set.
+func WithReducer(reduce Reducer, combine bool) Option {
+	return func(s *Sorter) {
+		s.reduce = reduce
+		s.combine = combine
+	}
+}
+
+// NewSorter returns a Sorter with the default settings changed by opts.
+func NewSorter(opts ...Option) *Sorter {
+	s := &Sorter{
+		allocateKey: key.AllocateString,
+		chunkRows:   defaultChunkRows,
+		bufferRows:  defaultBufferRows,
+		workers:     int64(runtime.NumCPU()),
+		tempDirs:    ChunkDirs(os.TempDir()),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Sort Read the rows of in and write them sorted to out.
+// If out is an AtomicWriter, it is committed once all the rows are written and aborted if the sort fails.
+func (s *Sorter) Sort(ctx context.Context, in io.Reader, out io.Writer) (err error) {
+	fn := "sort"
+	if s.inputCodec != nil {
+		decoded, err := s.inputCodec.NewReader(in)
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+		defer decoded.Close()
+		in = decoded
+	}
+	return errors.Wrap(s.run(ctx, s.newInfo(in, out)), fn)
+}
+
+// groupLimit returns the number of rows of a key held in memory by a join or a diff.
+func (s *Sorter) groupLimit() int {
+	if s.groupRows > 0 {
+		return s.groupRows
+	}
+	return defaultGroupRows
+}
+
+// newInfo returns the settings of a sort of in to out.
+func (s *Sorter) newInfo(in io.Reader, out io.Writer) *Info {
+	return &Info{
+		Reader:        in,
+		Allocate:      vector.DefaultVector(s.allocateKey),
+		MemoryBudget:  s.memoryBudget,
+		InMemorySize:  s.inMemorySize,
+		MaxRecordSize: s.maxRecordSize,
+		MergeWorkers:  s.mergeWorkers,
+		Progress:      s.progress,
+		Metrics:       s.metrics,
+		Framing:       s.framing,
+		Reduce:        s.reduce,
+		Combine:       s.combine,
+		OpenOutput: func(string) (AtomicWriter, error) {
+			return newStreamOutput(out, s.outputCodec)
+		},
+	}
+}
+
+// run Create the sorted chunks and merge them.
+func (s *Sorter) run(ctx context.Context, f *Info) error {
+	chunkPaths, err := f.CreateSortedChunks(ctx, s.tempDirs, s.chunkRows, s.workers)
+	if err != nil {
+		// the output is only opened by MergeSort
+		if output, err := f.openOutput(); err == nil {
+			output.Abort()
+		}
+		return err
+	}
+	return f.MergeSort(ctx, chunkPaths, s.bufferRows)
+}
+
+// sortPair Sort a and b at the same time by keyA and keyB. The sorted rows are read from the returned
+// pipes while both sides are merged, so only the chunks of the sorts are written to the temporary folders.
+// The rows are not encoded by the output codec. stop must be called with the error of the reading once done:
+// it stops the sorts if the reading failed and returns the first error of the reading or of the sorts.
+func (s *Sorter) sortPair(ctx context.Context, a, b io.Reader, keyA, keyB func(line string) (key.Key, error)) (sortedA, sortedB io.Reader, stop func(err error) error) {
+	ctx, cancel := context.WithCancel(ctx)
+	g, gctx := errgroup.WithContext(ctx)
+	sortStream := func(in io.Reader, allocateKey func(line string) (key.Key, error)) *io.PipeReader {
+		r, w := io.Pipe()
+		g.Go(func() error {
+			temp := *s
+			temp.allocateKey = allocateKey
+			temp.outputCodec = nil
+			err := temp.Sort(gctx, in, w)
+			// the reader gets the error of the sort, or io.EOF
+			w.CloseWithError(err)
+			return err
+		})
+		return r
+	}
+	readerA := sortStream(a, keyA)
+	readerB := sortStream(b, keyB)
+	stop = func(err error) error {
+		// a sort that already failed by itself is the cause of the error of the reading
+		sortFailed := gctx.Err() != nil
+		if err != nil {
+			cancel()
+		}
+		// a sort still writing rows fails instead of blocking
+		readerA.CloseWithError(err)
+		readerB.CloseWithError(err)
+		sortErr := g.Wait()
+		cancel()
+		if err != nil && !sortFailed {
+			return err
+		}
+		if sortErr != nil {
+			return sortErr
+		}
+		return err
+	}
+	return readerA, readerB, stop
+}
+
+// removeTemp Close and remove a temporary file, if any.
+func removeTemp(f *os.File) {
+	if f == nil {
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// rowFraming returns how the rows of the input and the output are delimited.
+func (s *Sorter) rowFraming() framing.Framing {
+	if s.framing == nil {
+		return framing.Newline
+	}
+	return s.framing
+}
+
+// sortedReader Read the rows of a sorted file and their keys.
+type sortedReader struct {
+	scanner     *bufio.Scanner
+	allocateKey func(line string) (key.Key, error)
+	line        string
+	key         key.Key
+	done        bool
+}
+
+func newSortedReader(r io.Reader, frame framing.Framing, maxRecordSize int, allocateKey func(line string) (key.Key, error)) *sortedReader {
+	scanner := framing.NewScanner(r, frame, maxRecordSize)
+	return &sortedReader{scanner: scanner, allocateKey: allocateKey}
+}
+
+// next Advance to the next row, done is set once all the rows are read.
+func (r *sortedReader) next() error {
+	if !r.scanner.Scan() {
+		r.done = true
+		return r.scanner.Err()
+	}
+	r.line = r.scanner.Text()
+	var err error
+	r.key, err = r.allocateKey(r.line)
+	return err
+}
+
+// streamOutput Write the output of a Sorter to a stream, encoded by an optional codec.
+type streamOutput struct {
+	io.Writer
+	out     io.Writer
+	encoder io.WriteCloser
+}
+
+func newStreamOutput(out io.Writer, codec Codec) (AtomicWriter, error) {
+	o := &streamOutput{Writer: out, out: out}
+	if codec != nil {
+		encoder, err := codec.NewWriter(out)
+		if err != nil {
+			return nil, err
+		}
+		o.Writer = encoder
+		o.encoder = encoder
+	}
+	return o, nil
+}
+
+// Commit Flush the encoded stream and commit out if it is an AtomicWriter.
+func (o *streamOutput) Commit() error {
+	if o.encoder != nil {
+		err := o.encoder.Close()
+		if err != nil {
+			o.Abort()
+			return err
+		}
+	}
+	if atomic, ok := o.out.(AtomicWriter); ok {
+		return atomic.Commit()
+	}
+	return nil
+}
+
+// canWriteAt returns true if the rows are not encoded and out is an AtomicWriter written at an offset,
+// such as the file of CreateAtomicFile. Any other stream may not start at offset 0.
+func (o *streamOutput) canWriteAt() bool {
+	if o.encoder != nil {
+		return false
+	}
+	_, ok := o.out.(AtomicWriter)
+	return ok && canWriteAt(o.out)
+}
+
+// WriteAt Write p at the offset off of out.
+func (o *streamOutput) WriteAt(p []byte, off int64) (int, error) {
+	output, ok := o.out.(io.WriterAt)
+	if !ok || !o.canWriteAt() {
+		return 0, errors.New("the output can not be written at an offset")
+	}
+	return output.WriteAt(p, off)
+}
+
+// Abort Abort out if it is an AtomicWriter. Rows already written to any other stream are left as is.
+func (o *streamOutput) Abort() error {
+	if atomic, ok := o.out.(AtomicWriter); ok {
+		return atomic.Abort()
+	}
+	return nil
+}
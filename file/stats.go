@@ -0,0 +1,155 @@
+package file
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stats Report of a sort, meant to be stored as JSON.
+type Stats struct {
+	KeySpec string `json:"key_spec"`
+	// RowsRead number of rows read from the input, including the bad ones.
+	RowsRead     int64 `json:"rows_read"`
+	RowsWritten  int64 `json:"rows_written"`
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+	BadRows      int   `json:"bad_rows"`
+	// InMemory the input was sorted without writing any chunk.
+	InMemory  bool         `json:"in_memory"`
+	Chunks    ChunkStats   `json:"chunks"`
+	Durations Durations    `json:"durations"`
+	Memory    *MemoryStats `json:"memory,omitempty"`
+}
+
+// ChunkStats Sizes of the chunks written while scanning the input.
+type ChunkStats struct {
+	Count    int   `json:"count"`
+	Bytes    int64 `json:"bytes"`
+	MinBytes int64 `json:"min_bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// Durations Time spent in every phase, in seconds.
+// Sort and dump are added up across the workers, so they can be longer than the scan.
+type Durations struct {
+	Scan  float64 `json:"scan"`
+	Sort  float64 `json:"sort"`
+	Dump  float64 `json:"dump"`
+	Merge float64 `json:"merge"`
+	Total float64 `json:"total"`
+}
+
+// MemoryStats Peak memory usage, only collected with PrintMemUsage.
+type MemoryStats struct {
+	MaxAlloc uint64 `json:"max_alloc"`
+	MaxSys   uint64 `json:"max_sys"`
+	NumGc    uint32 `json:"num_gc"`
+}
+
+// stats Collect the report of a sort from all the workers.
+type stats struct {
+	mu      sync.Mutex
+	report  Stats
+	started time.Time
+	// chunkBytes size of the chunk files still on disk, reported to the metrics.
+	chunkBytes int64
+}
+
+func newStats(keySpec string) *stats {
+	return &stats{
+		report:  Stats{KeySpec: keySpec},
+		started: time.Now(),
+	}
+}
+
+// update Change the report while holding the lock.
+func (s *stats) update(fn func(report *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.report)
+}
+
+// addChunk Record a chunk of size bytes.
+func (s *stats) addChunk(size int64) {
+	s.update(func(report *Stats) {
+		c := &report.Chunks
+		if c.Count == 0 || size < c.MinBytes {
+			c.MinBytes = size
+		}
+		if size > c.MaxBytes {
+			c.MaxBytes = size
+		}
+		c.Count++
+		c.Bytes += size
+	})
+}
+
+// Stats returns the report of the last sort.
+func (f *Info) Stats() Stats {
+	if f.runStats == nil {
+		return Stats{KeySpec: f.KeySpec}
+	}
+	f.runStats.mu.Lock()
+	defer f.runStats.mu.Unlock()
+	report := f.runStats.report
+	report.BadRows = f.BadRows()
+	if f.PrintMemUsage && f.mu != nil {
+		f.mu.lock.Lock()
+		report.Memory = &MemoryStats{MaxAlloc: f.mu.MaxAlloc, MaxSys: f.mu.MaxSys, NumGc: f.mu.NumGc}
+		f.mu.lock.Unlock()
+	}
+	return report
+}
+
+// WriteFile Store the report as JSON at path. The file is only visible once completely written.
+func (s Stats) WriteFile(path string) error {
+	fn := "write stats"
+	out, err := CreateAtomicFile(path)
+	if err != nil {
+		return errors.Wrap(err, fn)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(s)
+	if err != nil {
+		out.Abort()
+		return errors.Wrap(err, fn)
+	}
+	return errors.Wrap(out.Commit(), fn)
+}
+
+// countingOutput Count the bytes written to the output.
+type countingOutput struct {
+	AtomicWriter
+	stats *stats
+}
+
+func (o countingOutput) Write(p []byte) (int, error) {
+	n, err := o.AtomicWriter.Write(p)
+	o.stats.update(func(report *Stats) {
+		report.BytesWritten += int64(n)
+	})
+	return n, err
+}
+
+// canWriteAt returns true if the output can be written at an offset.
+func (o countingOutput) canWriteAt() bool {
+	return canWriteAt(o.AtomicWriter)
+}
+
+// WriteAt Write p at the offset off of the output, if it can be written at an offset.
+func (o countingOutput) WriteAt(p []byte, off int64) (int, error) {
+	output, ok := o.AtomicWriter.(io.WriterAt)
+	if !ok {
+		return 0, errors.New("the output can not be written at an offset")
+	}
+	n, err := output.WriteAt(p, off)
+	o.stats.update(func(report *Stats) {
+		report.BytesWritten += int64(n)
+	})
+	return n, err
+}
@@ -3,30 +3,263 @@ package file
 import (
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-// clearChunkFolder Remove all files from a folder.
-func clearChunkFolder(folder string) error {
-	fn := "clear folder"
-	err := os.MkdirAll(folder, os.ModePerm)
+const (
+	jobPrefix    = "job-"
+	lockFileName = "job.lock"
+	// lockRefreshInterval how often a running job refreshes the modification time of its lock file.
+	lockRefreshInterval = time.Minute
+)
+
+// errJobRunning the lock of a job folder is held by another sort.
+var errJobRunning = errors.New("job is already running")
+
+// job The isolated folders holding the chunks of a single sort, one per chunk folder.
+// The lock file inside each folder is refreshed while the job is running,
+// so CleanupJobs can tell orphaned folders from active ones.
+type job struct {
+	stop chan struct{}
+	wg   *sync.WaitGroup
+	dirs []string
+	// locks the open lock files, one per folder.
+	locks []*os.File
+	once  sync.Once
+	// resumable the chunks are kept if the merge fails.
+	resumable bool
+}
+
+// newJob Create a unique job folder in every chunk folder and lock them.
+func newJob(chunkFolders []string) (*job, error) {
+	fn := "new job"
+	dirs := make([]string, 0, len(chunkFolders))
+	for _, chunkFolder := range chunkFolders {
+		err := os.MkdirAll(chunkFolder, os.ModePerm)
+		if err == nil {
+			var dir string
+			dir, err = os.MkdirTemp(chunkFolder, jobPrefix+"*")
+			dirs = append(dirs, dir)
+		}
+		if err != nil {
+			removeAll(dirs)
+			return nil, errors.Wrap(err, fn)
+		}
+	}
+	j, err := startJob(dirs)
+	if err != nil {
+		removeAll(dirs)
+		return nil, errors.Wrap(err, fn)
+	}
+	return j, nil
+}
+
+// resumeJob Lock the job folders named name in every chunk folder, creating them if needed.
+// The content of existing folders is kept so they can be resumed.
+func resumeJob(chunkFolders []string, name string) (*job, error) {
+	fn := "resume job"
+	dirs := make([]string, 0, len(chunkFolders))
+	for _, chunkFolder := range chunkFolders {
+		dir := path.Join(chunkFolder, jobPrefix+name)
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		dirs = append(dirs, dir)
+	}
+	j, err := startJob(dirs)
+	if err != nil {
+		return nil, errors.Wrap(err, fn)
+	}
+	j.resumable = true
+	return j, nil
+}
+
+// startJob Lock every folder, write the process id in the lock files and start refreshing them.
+// The folders locked before an error are unlocked.
+func startJob(dirs []string) (*job, error) {
+	locks := make([]*os.File, 0, len(dirs))
+	unlock := func() {
+		for i, lock := range locks {
+			unlockJobDir(dirs[i], lock)
+		}
+	}
+	for _, dir := range dirs {
+		lock, err := lockJobDir(dir)
+		if errors.Is(err, errJobRunning) {
+			unlock()
+			return nil, errors.Wrap(err, dir)
+		}
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, lock)
+		err = lock.Truncate(0)
+		if err == nil {
+			_, err = lock.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+		}
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	j := &job{
+		dirs:  dirs,
+		locks: locks,
+		stop:  make(chan struct{}),
+		wg:    &sync.WaitGroup{},
+	}
+	j.wg.Add(1)
+	go j.heartbeat()
+	return j, nil
+}
+
+// heartbeat Refresh the lock files until the job is released.
+func (j *job) heartbeat() {
+	defer j.wg.Done()
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case now := <-ticker.C:
+			for _, dir := range j.dirs {
+				// a failed refresh only makes the job look older to CleanupJobs
+				_ = os.Chtimes(path.Join(dir, lockFileName), now, now)
+			}
+		}
+	}
+}
+
+// release Stop refreshing the locks and remove them. The chunks are kept.
+func (j *job) release() error {
+	j.once.Do(func() {
+		close(j.stop)
+		j.wg.Wait()
+	})
+	locks := j.locks
+	j.locks = nil
+	var err error
+	for i, lock := range locks {
+		unlockErr := unlockJobDir(j.dirs[i], lock)
+		if err == nil && unlockErr != nil {
+			err = errors.Wrap(unlockErr, "release job")
+		}
+	}
+	return err
+}
+
+// remove Release the job and delete its folders with all the chunks.
+func (j *job) remove() error {
+	err := j.release()
 	if err != nil {
-		return errors.Wrap(err, fn)
+		return err
+	}
+	return errors.Wrap(removeAll(j.dirs), "remove job")
+}
+
+// clear Remove everything but the lock files from the job folders.
+func (j *job) clear() error {
+	for _, jobDir := range j.dirs {
+		dir, err := os.ReadDir(jobDir)
+		if err != nil {
+			return errors.Wrap(err, "clear job")
+		}
+		for _, d := range dir {
+			if d.Name() == lockFileName {
+				continue
+			}
+			err = os.RemoveAll(path.Join(jobDir, d.Name()))
+			if err != nil {
+				return errors.Wrap(err, "clear job")
+			}
+		}
 	}
-	dir, err := os.ReadDir(folder)
+	return nil
+}
+
+// removeAll Remove all the folders and their content.
+func removeAll(dirs []string) error {
+	for _, dir := range dirs {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanupJobs Remove the job folders in chunkFolder that have not been refreshed for longer than maxAge.
+// Those folders belong to sorts that crashed or were killed. It returns the removed folders.
+// A folder whose lock is still held by a running sort is kept.
+func CleanupJobs(chunkFolder string, maxAge time.Duration) ([]string, error) {
+	fn := "cleanup jobs"
+	dir, err := os.ReadDir(chunkFolder)
 	if err != nil {
-		return errors.Wrap(err, fn)
+		return nil, errors.Wrap(err, fn)
 	}
+	removed := []string{}
 	for _, d := range dir {
-		if !strings.HasPrefix(d.Name(), "chunk") {
+		if !d.IsDir() || !strings.HasPrefix(d.Name(), jobPrefix) {
+			continue
+		}
+		jobDir := path.Join(chunkFolder, d.Name())
+		// use the folder itself if the job died before creating its lock
+		info, err := os.Stat(path.Join(jobDir, lockFileName))
+		if os.IsNotExist(err) {
+			info, err = d.Info()
+		}
+		if err != nil {
+			return removed, errors.Wrap(err, fn)
+		}
+		if time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		err = removeJobDir(jobDir)
+		if errors.Is(err, errJobRunning) {
 			continue
 		}
-		err = os.RemoveAll(path.Join(folder, d.Name()))
 		if err != nil {
-			return errors.Wrap(err, fn)
+			return removed, errors.Wrap(err, fn)
 		}
+		removed = append(removed, jobDir)
 	}
-	return nil
+	return removed, nil
+}
+
+// removeJobDir Take the lock of the job folder dir and remove the folder.
+// It returns errJobRunning if the lock is held, the job is still running however old its lock looks.
+func removeJobDir(dir string) error {
+	lock, err := lockJobDir(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		unlockJobDir(dir, lock)
+		return err
+	}
+	// the lock file is kept until the chunks are removed, so no job can resume from them meanwhile
+	for _, entry := range entries {
+		if entry.Name() == lockFileName {
+			continue
+		}
+		err = os.RemoveAll(path.Join(dir, entry.Name()))
+		if err != nil {
+			unlockJobDir(dir, lock)
+			return err
+		}
+	}
+	err = unlockJobDir(dir, lock)
+	if err != nil {
+		return err
+	}
+	return os.Remove(dir)
 }
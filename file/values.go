@@ -0,0 +1,162 @@
+package file
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/vector"
+	"github.com/askiada/external-sort/vector/key"
+
+	"github.com/pkg/errors"
+)
+
+// ValueCodec Encode and decode the values sorted by a ValueSorter, e.g. as protobuf or msgpack messages.
+type ValueCodec interface {
+	Encode(value interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+// ValueSource returns the values to sort one by one, and io.EOF once they have all been returned.
+type ValueSource func() (interface{}, error)
+
+// ValueSorter Sort Go values instead of lines.
+// Values are encoded by a codec and stored in binary chunks, every row preceded by its length.
+type ValueSorter struct {
+	sorter *Sorter
+	codec  ValueCodec
+	less   func(a, b interface{}) bool
+}
+
+// NewValueSorter returns a sorter of the values encoded by codec, in the order defined by less.
+// WithKey, WithFraming and the codecs of opts are not used.
+func NewValueSorter(codec ValueCodec, less func(a, b interface{}) bool, opts ...Option) *ValueSorter {
+	return &ValueSorter{
+		sorter: NewSorter(opts...),
+		codec:  codec,
+		less:   less,
+	}
+}
+
+// valueKey A decoded value compared with the less function of the sorter.
+type valueKey struct {
+	value interface{}
+	less  func(a, b interface{}) bool
+}
+
+func (k *valueKey) Less(other key.Key) bool {
+	return k.less(k.value, other.(*valueKey).value)
+}
+
+// allocateKey Decode a row into its value.
+func (s *ValueSorter) allocateKey(line string) (key.Key, error) {
+	value, err := s.codec.Decode([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	return &valueKey{value: value, less: s.less}, nil
+}
+
+// Sort Sort the values returned by source. The sorted values are read from the returned iterator
+// while they are merged, the iterator must be closed once done.
+func (s *ValueSorter) Sort(ctx context.Context, source ValueSource) *ValueIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	it := &ValueIterator{
+		codec:   s.codec,
+		scanner: framing.NewScanner(outReader, framing.LengthPrefixed, s.sorter.maxRecordSize),
+		reader:  outReader,
+		cancel:  cancel,
+	}
+	it.wg.Add(2)
+	go func() {
+		defer it.wg.Done()
+		inWriter.CloseWithError(s.encode(source, inWriter))
+	}()
+	go func() {
+		defer it.wg.Done()
+		f := s.sorter.newInfo(inReader, outWriter)
+		f.Allocate = vector.DefaultVector(s.allocateKey)
+		f.Framing = framing.LengthPrefixed
+		f.OpenOutput = func(string) (AtomicWriter, error) {
+			return newStreamOutput(outWriter, nil)
+		}
+		err := s.sorter.run(ctx, f)
+		// stop the encoding if the sort failed before reading all the values
+		inReader.CloseWithError(err)
+		outWriter.CloseWithError(err)
+	}()
+	return it
+}
+
+// encode Write the values of source to w, every one preceded by its length.
+func (s *ValueSorter) encode(source ValueSource, w io.Writer) error {
+	fn := "encode values"
+	bw := bufio.NewWriter(w)
+	framed := []byte{}
+	for {
+		value, err := source()
+		if err == io.EOF {
+			return errors.Wrap(bw.Flush(), fn)
+		}
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+		data, err := s.codec.Encode(value)
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+		framed, err = framing.LengthPrefixed.Append(framed[:0], string(data))
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+		_, err = bw.Write(framed)
+		if err != nil {
+			return errors.Wrap(err, fn)
+		}
+	}
+}
+
+// ValueIterator Read the values sorted by a ValueSorter in ascending order.
+type ValueIterator struct {
+	codec   ValueCodec
+	scanner *bufio.Scanner
+	reader  *io.PipeReader
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	value   interface{}
+	err     error
+}
+
+// Next Advance to the next value. It returns false once all the values are read or on error.
+func (it *ValueIterator) Next() bool {
+	if it.err != nil || !it.scanner.Scan() {
+		return false
+	}
+	it.value, it.err = it.codec.Decode(it.scanner.Bytes())
+	return it.err == nil
+}
+
+// Value returns the current value.
+func (it *ValueIterator) Value() interface{} {
+	return it.value
+}
+
+// Err returns the first error of the sort or of the decoding.
+func (it *ValueIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.scanner.Err()
+}
+
+// Close Stop the sort if the values are not all read, and wait for it to clean up its chunks.
+func (it *ValueIterator) Close() error {
+	it.cancel()
+	it.reader.Close()
+	it.wg.Wait()
+	return nil
+}
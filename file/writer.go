@@ -0,0 +1,150 @@
+package file
+
+import (
+	"bufio"
+
+	"github.com/askiada/external-sort/file/chunkfile"
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/vector"
+)
+
+// rowWriter Destination of the merged rows.
+type rowWriter interface {
+	// writeRows Write all the rows and reset the vector.
+	writeRows(rows vector.Vector) error
+	// flush Write the rows still buffered.
+	flush() error
+}
+
+// textWriter Write the rows delimited by framing and count them in the report and the metrics.
+type textWriter struct {
+	w       *bufio.Writer
+	stats   *stats
+	metrics Metrics
+	framing framing.Framing
+}
+
+func (tw textWriter) writeRows(rows vector.Vector) error {
+	n := int64(rows.Len())
+	tw.stats.update(func(report *Stats) {
+		report.RowsWritten += n
+	})
+	tw.metrics.AddMergeRows(n)
+	return writeFramed(tw.w, rows, tw.framing)
+}
+
+func (tw textWriter) flush() error {
+	return tw.w.Flush()
+}
+
+// chunkWriter Write the rows in a chunk file. The chunk is closed by the caller.
+type chunkWriter struct {
+	w *chunkfile.Writer
+}
+
+func (cw chunkWriter) writeRows(rows vector.Vector) error {
+	for i := 0; i < rows.Len(); i++ {
+		err := cw.w.WriteRow(rows.Get(i).Line)
+		if err != nil {
+			return err
+		}
+	}
+	rows.Reset()
+	return nil
+}
+
+func (cw chunkWriter) flush() error {
+	return nil
+}
+
+// dumpChunk Write all the rows of the vector in the chunk and close it.
+// The chunk is removed if a row can not be written.
+// It returns the footer written at the end of the chunk.
+func dumpChunk(v vector.Vector, w *chunkfile.Writer) (*chunkfile.Footer, error) {
+	for i := 0; i < v.Len(); i++ {
+		err := w.WriteRow(v.Get(i).Line)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+	}
+	return w.Close()
+}
+
+// createChunk Create a chunk file at chunkPath, binary if the rows can contain newlines.
+func (f *Info) createChunk(chunkPath string) (*chunkfile.Writer, error) {
+	if f.binaryChunks() {
+		return chunkfile.CreateBinary(chunkPath, f.SyncChunks)
+	}
+	return chunkfile.Create(chunkPath, f.SyncChunks)
+}
+
+// backgroundWriter Format and write the merged rows in a dedicated goroutine.
+// Buffers are swapped between the merge and the writer: the merge fills one buffer while
+// the other one is written. The merge waits when the writer falls behind,
+// and stops as soon as a write fails.
+type backgroundWriter struct {
+	w      rowWriter
+	full   chan vector.Vector
+	empty  chan vector.Vector
+	failed chan struct{}
+	done   chan struct{}
+	err    error
+	closed bool
+}
+
+// newBackgroundWriter Start writing to w the buffers returned by write.
+// buffers are the spare buffers handed back to the merge once written.
+func newBackgroundWriter(w rowWriter, buffers ...vector.Vector) *backgroundWriter {
+	bw := &backgroundWriter{
+		w:      w,
+		full:   make(chan vector.Vector),
+		empty:  make(chan vector.Vector, len(buffers)+1),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, buffer := range buffers {
+		bw.empty <- buffer
+	}
+	go bw.run()
+	return bw
+}
+
+func (bw *backgroundWriter) run() {
+	defer close(bw.done)
+	for rows := range bw.full {
+		err := bw.w.writeRows(rows)
+		if err != nil {
+			bw.err = err
+			close(bw.failed)
+			return
+		}
+		bw.empty <- rows
+	}
+	bw.err = bw.w.flush()
+}
+
+// write Hand rows over to the writer and return an empty buffer to fill.
+func (bw *backgroundWriter) write(rows vector.Vector) (vector.Vector, error) {
+	select {
+	case bw.full <- rows:
+	case <-bw.failed:
+		return nil, bw.err
+	}
+	select {
+	case next := <-bw.empty:
+		return next, nil
+	case <-bw.failed:
+		return nil, bw.err
+	}
+}
+
+// close Wait for all the rows to be written and flush them.
+func (bw *backgroundWriter) close() error {
+	if !bw.closed {
+		bw.closed = true
+		close(bw.full)
+	}
+	<-bw.done
+	return bw.err
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/askiada/external-sort/file"
+	"github.com/pkg/errors"
+)
+
+// ParseChunkDirs Parse a comma separated list of chunk folders.
+// Each folder can be followed by a quota, e.g. /mnt/disk1/chunks:100G,/mnt/disk2/chunks.
+// Anything after the last colon starting with a digit must be a valid quota.
+func ParseChunkDirs(spec string) ([]file.ChunkDir, error) {
+	dirs := []file.ChunkDir{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		dir := file.ChunkDir{Path: entry}
+		if idx := strings.LastIndex(entry, ":"); idx > 0 {
+			suffix := entry[idx+1:]
+			quota, err := ParseSize(suffix)
+			if err == nil {
+				dir = file.ChunkDir{Path: entry[:idx], Quota: quota}
+			} else if suffix != "" && suffix[0] >= '0' && suffix[0] <= '9' {
+				return nil, errors.Wrapf(err, "quota of chunk folder %s", entry[:idx])
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		return nil, errors.New("no chunk folder")
+	}
+	return dirs, nil
+}
+
+// ParseSize Parse a number of bytes with an optional K, M, G or T suffix (powers of 1024).
+func ParseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid size %s", s)
+	}
+	return n * multiplier, nil
+}
+
+// ParsePlacement Parse the name of a chunk placement policy.
+func ParsePlacement(name string) (file.Placement, error) {
+	switch name {
+	case "", "round_robin":
+		return file.RoundRobin, nil
+	case "free_space":
+		return file.FreeSpace, nil
+	}
+	return file.RoundRobin, errors.Errorf("unknown chunk placement %s", name)
+}
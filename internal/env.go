@@ -14,6 +14,46 @@ const (
 	ChunkSizeName        = "chunk_size"
 	MaxWorkersName       = "max_workers"
 	OutputBufferSizeName = "output_buffer_size"
+	SyncChunksName       = "sync_chunks"
+	CleanupAgeName       = "cleanup_age"
+	ResumeName           = "resume"
+	ChunkPlacementName   = "chunk_placement"
+	ReadAheadName        = "read_ahead"
+	MemoryBudgetName     = "memory_budget"
+	InMemorySizeName     = "in_memory_size"
+	MaxRecordSizeName    = "max_record_size"
+	MergeWorkersName     = "merge_workers"
+	CascadeFactorName    = "cascade_factor"
+	StableName           = "stable"
+	LimitName            = "limit"
+	ReverseName          = "reverse"
+	BadRowsName          = "bad_rows"
+	QuarantinePathName   = "quarantine_path"
+	MaxErrorsName        = "max_errors"
+	StatsFileName        = "stats_file"
+	ProgressName         = "progress"
+	MetricsAddrName      = "metrics_addr"
+	FramingName          = "framing"
+	SourceColumnName     = "source_column"
+	SFTPAddrName         = "sftp_addr"
+	SFTPUserName         = "sftp_user"
+	SFTPKeyName          = "sftp_key"
+	SFTPPassphraseName   = "sftp_passphrase"
+	SFTPOutputName       = "sftp_output"
+	PartitionRowsName    = "partition_rows"
+	PartitionSizeName    = "partition_size"
+	PartitionsName       = "partitions"
+	GroupByKeyName       = "group_by_key"
+	GroupExtensionName   = "group_extension"
+	LeftPathName         = "left_path"
+	RightPathName        = "right_path"
+	LeftKeyName          = "left_key"
+	RightKeyName         = "right_key"
+	JoinTypeName         = "join_type"
+	JoinColumnsName      = "join_columns"
+	GroupRowsName        = "group_rows"
+	ReduceName           = "reduce"
+	CombineName          = "combine"
 )
 
 // Environment variables.
@@ -24,6 +64,46 @@ var (
 	ChunkSize        int
 	MaxWorkers       int64
 	OutputBufferSize int
+	SyncChunks       bool
+	CleanupAge       int
+	Resume           bool
+	ChunkPlacement   string
+	ReadAhead        bool
+	MemoryBudget     string
+	InMemorySize     string
+	MaxRecordSize    string
+	MergeWorkers     int
+	CascadeFactor    int
+	Stable           bool
+	Limit            int
+	Reverse          bool
+	BadRows          string
+	QuarantinePath   string
+	MaxErrors        int
+	StatsFile        string
+	Progress         string
+	MetricsAddr      string
+	Framing          string
+	SourceColumn     bool
+	SFTPAddr         string
+	SFTPUser         string
+	SFTPKey          string
+	SFTPPassphrase   string
+	SFTPOutput       bool
+	PartitionRows    int
+	PartitionSize    string
+	Partitions       int
+	GroupByKey       bool
+	GroupExtension   string
+	LeftPath         string
+	RightPath        string
+	LeftKey          int
+	RightKey         int
+	JoinType         string
+	JoinColumns      string
+	GroupRows        int
+	Reduce           string
+	Combine          bool
 )
 
 func init() {
@@ -34,4 +114,44 @@ func init() {
 	viper.SetDefault(ChunkSizeName, 0)
 	viper.SetDefault(MaxWorkersName, 0)
 	viper.SetDefault(OutputBufferSizeName, 0)
+	viper.SetDefault(SyncChunksName, false)
+	viper.SetDefault(CleanupAgeName, 24)
+	viper.SetDefault(ResumeName, false)
+	viper.SetDefault(ChunkPlacementName, "round_robin")
+	viper.SetDefault(ReadAheadName, false)
+	viper.SetDefault(MemoryBudgetName, "0")
+	viper.SetDefault(InMemorySizeName, "0")
+	viper.SetDefault(MaxRecordSizeName, "0")
+	viper.SetDefault(MergeWorkersName, 1)
+	viper.SetDefault(CascadeFactorName, 0)
+	viper.SetDefault(StableName, false)
+	viper.SetDefault(LimitName, 0)
+	viper.SetDefault(ReverseName, false)
+	viper.SetDefault(BadRowsName, "fail")
+	viper.SetDefault(QuarantinePathName, "")
+	viper.SetDefault(MaxErrorsName, 0)
+	viper.SetDefault(StatsFileName, "")
+	viper.SetDefault(ProgressName, "bar")
+	viper.SetDefault(MetricsAddrName, "")
+	viper.SetDefault(FramingName, "newline")
+	viper.SetDefault(SourceColumnName, false)
+	viper.SetDefault(SFTPAddrName, "")
+	viper.SetDefault(SFTPUserName, "")
+	viper.SetDefault(SFTPKeyName, "")
+	viper.SetDefault(SFTPPassphraseName, "")
+	viper.SetDefault(SFTPOutputName, false)
+	viper.SetDefault(PartitionRowsName, 0)
+	viper.SetDefault(PartitionSizeName, "0")
+	viper.SetDefault(PartitionsName, 0)
+	viper.SetDefault(GroupByKeyName, false)
+	viper.SetDefault(GroupExtensionName, "")
+	viper.SetDefault(LeftPathName, "")
+	viper.SetDefault(RightPathName, "")
+	viper.SetDefault(LeftKeyName, 0)
+	viper.SetDefault(RightKeyName, 0)
+	viper.SetDefault(JoinTypeName, "inner")
+	viper.SetDefault(JoinColumnsName, "")
+	viper.SetDefault(GroupRowsName, 0)
+	viper.SetDefault(ReduceName, "")
+	viper.SetDefault(CombineName, false)
 }
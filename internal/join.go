@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/askiada/external-sort/file"
+	"github.com/pkg/errors"
+)
+
+// ParseJoinType Parse the name of a join type.
+func ParseJoinType(name string) (file.JoinType, error) {
+	switch name {
+	case "", "inner":
+		return file.InnerJoin, nil
+	case "left":
+		return file.LeftJoin, nil
+	case "right":
+		return file.RightJoin, nil
+	case "full":
+		return file.FullJoin, nil
+	}
+	return file.InnerJoin, errors.Errorf("unknown join type %s", name)
+}
+
+// ParseJoinColumns Parse comma separated columns of the joined rows, e.g. l0,r2 for the first left column
+// and the third right column. It returns nil for an empty list.
+func ParseJoinColumns(list string) ([]file.JoinColumn, error) {
+	if list == "" {
+		return nil, nil
+	}
+	columns := []file.JoinColumn{}
+	for _, name := range strings.Split(list, ",") {
+		if len(name) < 2 || (name[0] != 'l' && name[0] != 'r') {
+			return nil, errors.Errorf("invalid join column %s", name)
+		}
+		pos, err := strconv.Atoi(name[1:])
+		if err != nil || pos < 0 {
+			return nil, errors.Errorf("invalid join column %s", name)
+		}
+		columns = append(columns, file.JoinColumn{Right: name[0] == 'r', Column: pos})
+	}
+	return columns, nil
+}
@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// ServeMetrics Serve handler on /metrics at addr in the background.
+// The address is checked before returning, the server is stopped by closing it.
+// Errors of the server after it started are logged.
+func ServeMetrics(addr string, handler http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "metrics")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	server := &http.Server{Handler: mux}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("metrics: %v", err)
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/askiada/external-sort/file"
+	"github.com/pkg/errors"
+)
+
+// progressInterval time between two progress logs.
+const progressInterval = 10 * time.Second
+
+// ParseProgress Parse the name of a progress reporter.
+func ParseProgress(name string) (file.ProgressReporter, error) {
+	switch name {
+	case "", "bar":
+		return file.NewBarReporter(), nil
+	case "log":
+		return file.NewLogReporter(log.New(os.Stderr, "", log.LstdFlags), progressInterval), nil
+	case "none":
+		return file.NoProgress{}, nil
+	}
+	return nil, errors.Errorf("unknown progress reporter %s", name)
+}
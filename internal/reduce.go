@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/askiada/external-sort/file"
+	"github.com/pkg/errors"
+)
+
+// ParseReducer Parse the name of a reducer: count, sum:N, min:N, max:N, first, last or concat:N,
+// N being the position of the tab separated column. It returns nil for an empty name.
+func ParseReducer(name string) (file.Reducer, error) {
+	parts := strings.SplitN(name, ":", 2)
+	op := parts[0]
+	hasColumn := len(parts) == 2
+	pos := 0
+	if hasColumn {
+		var err error
+		pos, err = strconv.Atoi(parts[1])
+		if err != nil || pos < 0 {
+			return nil, errors.Errorf("invalid reducer column %s", name)
+		}
+	}
+	switch {
+	case name == "":
+		return nil, nil
+	case op == "count" && !hasColumn:
+		return file.Count{}, nil
+	case op == "first" && !hasColumn:
+		return file.First{}, nil
+	case op == "last" && !hasColumn:
+		return file.Last{}, nil
+	case op == "sum" && hasColumn:
+		return file.Sum{Column: pos}, nil
+	case op == "min" && hasColumn:
+		return file.Min{Column: pos}, nil
+	case op == "max" && hasColumn:
+		return file.Max{Column: pos}, nil
+	case op == "concat" && hasColumn:
+		return file.ConcatDistinct{Column: pos, Sep: ","}, nil
+	}
+	return nil, errors.Errorf("unknown reducer %s", name)
+}
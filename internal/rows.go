@@ -0,0 +1,19 @@
+package internal
+
+import (
+	"github.com/askiada/external-sort/file"
+	"github.com/pkg/errors"
+)
+
+// ParseRowPolicy Parse the name of a bad row policy.
+func ParseRowPolicy(name string) (file.RowPolicy, error) {
+	switch name {
+	case "", "fail":
+		return file.FailOnBadRow, nil
+	case "skip":
+		return file.SkipBadRows, nil
+	case "quarantine":
+		return file.QuarantineBadRows, nil
+	}
+	return file.FailOnBadRow, errors.Errorf("unknown bad row policy %s", name)
+}
@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/askiada/external-sort/file"
+	"github.com/askiada/external-sort/file/framing"
 	"github.com/askiada/external-sort/internal"
+	"github.com/askiada/external-sort/sftp"
 	"github.com/askiada/external-sort/vector"
 	"github.com/askiada/external-sort/vector/key"
 	"github.com/spf13/cobra"
@@ -21,50 +27,398 @@ func main() {
 		RunE:  rootRun,
 	}
 
-	rootCmd.PersistentFlags().StringVarP(&internal.InputFile, internal.InputFileName, "i", viper.GetString(internal.InputFileName), "input file path.")
+	rootCmd.PersistentFlags().StringVarP(&internal.InputFile, internal.InputFileName, "i", viper.GetString(internal.InputFileName), "comma separated input file paths or globs.")
 	rootCmd.PersistentFlags().StringVarP(&internal.OutputFile, internal.OutputFileName, "o", viper.GetString(internal.OutputFileName), "output file path.")
-	rootCmd.PersistentFlags().StringVarP(&internal.ChunkFolder, internal.ChunkFolderName, "c", viper.GetString(internal.ChunkFolderName), "chunk folder.")
+	rootCmd.PersistentFlags().StringVarP(&internal.ChunkFolder, internal.ChunkFolderName, "c", viper.GetString(internal.ChunkFolderName), "comma separated chunk folders, each one optionally followed by a quota (e.g. /mnt/disk1:100G).")
+	rootCmd.PersistentFlags().StringVar(&internal.ChunkPlacement, internal.ChunkPlacementName, viper.GetString(internal.ChunkPlacementName), "chunk placement across chunk folders: round_robin or free_space.")
 
 	rootCmd.PersistentFlags().IntVarP(&internal.ChunkSize, internal.ChunkSizeName, "s", viper.GetInt(internal.ChunkSizeName), "chunk size.")
 	rootCmd.PersistentFlags().Int64VarP(&internal.MaxWorkers, internal.MaxWorkersName, "w", viper.GetInt64(internal.MaxWorkersName), "max worker.")
 	rootCmd.PersistentFlags().IntVarP(&internal.OutputBufferSize, internal.OutputBufferSizeName, "b", viper.GetInt(internal.OutputBufferSizeName), "output buffer size.")
+	rootCmd.PersistentFlags().BoolVar(&internal.SyncChunks, internal.SyncChunksName, viper.GetBool(internal.SyncChunksName), "fsync chunk files.")
+	rootCmd.PersistentFlags().BoolVar(&internal.ReadAhead, internal.ReadAheadName, viper.GetBool(internal.ReadAheadName), "read the next rows of every chunk in the background during the merge.")
+	rootCmd.PersistentFlags().StringVar(&internal.MemoryBudget, internal.MemoryBudgetName, viper.GetString(internal.MemoryBudgetName), "memory used by the read-ahead buffers (e.g. 512M), 0 means no limit.")
+	rootCmd.PersistentFlags().StringVar(&internal.InMemorySize, internal.InMemorySizeName, viper.GetString(internal.InMemorySizeName), "sort in memory the inputs up to this size (e.g. 64M) even when they hold more rows than a chunk.")
+	rootCmd.PersistentFlags().StringVar(&internal.MaxRecordSize, internal.MaxRecordSizeName, viper.GetString(internal.MaxRecordSizeName), "maximum size of a row (e.g. 256M), 0 means 64M.")
+	rootCmd.PersistentFlags().IntVar(&internal.MergeWorkers, internal.MergeWorkersName, viper.GetInt(internal.MergeWorkersName), "number of key ranges merged in parallel.")
+	rootCmd.PersistentFlags().IntVar(&internal.CascadeFactor, internal.CascadeFactorName, viper.GetInt(internal.CascadeFactorName), "merge every N chunks into a larger run while the input is read, 0 disables it.")
+	rootCmd.PersistentFlags().BoolVar(&internal.Stable, internal.StableName, viper.GetBool(internal.StableName), "keep the input order of rows with equal keys inside every chunk.")
+	rootCmd.PersistentFlags().IntVar(&internal.Limit, internal.LimitName, viper.GetInt(internal.LimitName), "only write the first N rows, 0 writes all of them.")
+	rootCmd.PersistentFlags().BoolVar(&internal.Reverse, internal.ReverseName, viper.GetBool(internal.ReverseName), "sort in descending order.")
+	rootCmd.PersistentFlags().StringVar(&internal.BadRows, internal.BadRowsName, viper.GetString(internal.BadRowsName), "what to do with rows whose key can not be read: fail, skip or quarantine.")
+	rootCmd.PersistentFlags().StringVar(&internal.QuarantinePath, internal.QuarantinePathName, viper.GetString(internal.QuarantinePathName), "file receiving the bad rows with --bad_rows quarantine.")
+	rootCmd.PersistentFlags().IntVar(&internal.MaxErrors, internal.MaxErrorsName, viper.GetInt(internal.MaxErrorsName), "fail once more than this many bad rows are skipped or quarantined, 0 means no limit.")
+	rootCmd.PersistentFlags().StringVar(&internal.StatsFile, internal.StatsFileName, viper.GetString(internal.StatsFileName), "write a JSON report of the sort to this file.")
+	rootCmd.PersistentFlags().StringVar(&internal.Progress, internal.ProgressName, viper.GetString(internal.ProgressName), "how the progress is reported: bar, log or none.")
+	rootCmd.PersistentFlags().StringVar(&internal.Framing, internal.FramingName, viper.GetString(internal.FramingName), "how the rows of the input and the output are delimited: newline, nul, length (uvarint length prefix) or fixed:N.")
+	rootCmd.PersistentFlags().StringVar(&internal.MetricsAddr, internal.MetricsAddrName, viper.GetString(internal.MetricsAddrName), "serve Prometheus metrics on /metrics at this address (e.g. :9090).")
+	rootCmd.PersistentFlags().BoolVar(&internal.SourceColumn, internal.SourceColumnName, viper.GetBool(internal.SourceColumnName), "add the input file path to every row as a last column.")
+	rootCmd.PersistentFlags().StringVar(&internal.SFTPAddr, internal.SFTPAddrName, viper.GetString(internal.SFTPAddrName), "read the inputs from this SFTP server (e.g. host:22).")
+	rootCmd.PersistentFlags().StringVar(&internal.SFTPUser, internal.SFTPUserName, viper.GetString(internal.SFTPUserName), "SFTP user.")
+	rootCmd.PersistentFlags().StringVar(&internal.SFTPKey, internal.SFTPKeyName, viper.GetString(internal.SFTPKeyName), "SFTP private key file.")
+	rootCmd.PersistentFlags().StringVar(&internal.SFTPPassphrase, internal.SFTPPassphraseName, viper.GetString(internal.SFTPPassphraseName), "SFTP private key passphrase.")
+	rootCmd.PersistentFlags().BoolVar(&internal.SFTPOutput, internal.SFTPOutputName, viper.GetBool(internal.SFTPOutputName), "write the output on the SFTP server too.")
+	rootCmd.PersistentFlags().IntVar(&internal.PartitionRows, internal.PartitionRowsName, viper.GetInt(internal.PartitionRowsName), "split the output in files of at least N rows, named after the output path.")
+	rootCmd.PersistentFlags().StringVar(&internal.PartitionSize, internal.PartitionSizeName, viper.GetString(internal.PartitionSizeName), "split the output in files of at least this size (e.g. 1G), named after the output path.")
+	rootCmd.PersistentFlags().IntVar(&internal.Partitions, internal.PartitionsName, viper.GetInt(internal.PartitionsName), "split the output in N files at quantiles of the keys, named after the output path.")
+	rootCmd.PersistentFlags().BoolVar(&internal.GroupByKey, internal.GroupByKeyName, viper.GetBool(internal.GroupByKeyName), "write a file per key, named after the key, in the output path folder, which must be empty.")
+	rootCmd.PersistentFlags().StringVar(&internal.GroupExtension, internal.GroupExtensionName, viper.GetString(internal.GroupExtensionName), "extension of the files of --group_by_key (e.g. .csv), .tsv by default for the newline framing.")
+	rootCmd.PersistentFlags().StringVar(&internal.Reduce, internal.ReduceName, viper.GetString(internal.ReduceName), "collapse the rows with equal keys: count, sum:N, min:N, max:N, first, last or concat:N, N being a column.")
+	rootCmd.PersistentFlags().BoolVar(&internal.Combine, internal.CombineName, viper.GetBool(internal.CombineName), "also collapse the rows with equal keys of every chunk with --reduce.")
+	rootCmd.PersistentFlags().BoolVar(&internal.Resume, internal.ResumeName, viper.GetBool(internal.ResumeName), "keep the chunks if the merge fails and reuse them on the next run.")
+
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove the job folders left in the chunk folder by sorts that did not finish",
+		RunE:  cleanupRun,
+	}
+	cleanupCmd.Flags().IntVar(&internal.CleanupAge, internal.CleanupAgeName, viper.GetInt(internal.CleanupAgeName), "remove job folders inactive for this many hours.")
+	rootCmd.AddCommand(cleanupCmd)
+
+	joinCmd := &cobra.Command{
+		Use:   "join",
+		Short: "Sort two TSV files by key and join their rows with equal keys",
+		RunE:  joinRun,
+	}
+	joinCmd.Flags().StringVar(&internal.LeftPath, internal.LeftPathName, viper.GetString(internal.LeftPathName), "left input file path.")
+	joinCmd.Flags().StringVar(&internal.RightPath, internal.RightPathName, viper.GetString(internal.RightPathName), "right input file path.")
+	joinCmd.Flags().IntVar(&internal.LeftKey, internal.LeftKeyName, viper.GetInt(internal.LeftKeyName), "column of the key of the left rows.")
+	joinCmd.Flags().IntVar(&internal.RightKey, internal.RightKeyName, viper.GetInt(internal.RightKeyName), "column of the key of the right rows.")
+	joinCmd.Flags().StringVar(&internal.JoinType, internal.JoinTypeName, viper.GetString(internal.JoinTypeName), "join type: inner, left, right or full.")
+	joinCmd.Flags().StringVar(&internal.JoinColumns, internal.JoinColumnsName, viper.GetString(internal.JoinColumnsName), "comma separated columns of the joined rows (e.g. l0,l1,r2), all the columns of both rows by default.")
+	joinCmd.Flags().IntVar(&internal.GroupRows, internal.GroupRowsName, viper.GetInt(internal.GroupRowsName), "right rows with the same key held in memory before they are spilled to disk, 0 uses the default.")
+	rootCmd.AddCommand(joinCmd)
+
+	diffCmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Sort two TSV files by key and write the rows only in the left file, only in the right file and changed",
+		RunE:  diffRun,
+	}
+	diffCmd.Flags().StringVar(&internal.LeftPath, internal.LeftPathName, viper.GetString(internal.LeftPathName), "left input file path.")
+	diffCmd.Flags().StringVar(&internal.RightPath, internal.RightPathName, viper.GetString(internal.RightPathName), "right input file path.")
+	diffCmd.Flags().IntVar(&internal.LeftKey, internal.LeftKeyName, viper.GetInt(internal.LeftKeyName), "column of the key of the left rows.")
+	diffCmd.Flags().IntVar(&internal.RightKey, internal.RightKeyName, viper.GetInt(internal.RightKeyName), "column of the key of the right rows.")
+	diffCmd.Flags().IntVar(&internal.GroupRows, internal.GroupRowsName, viper.GetInt(internal.GroupRowsName), "rows with the same key found in a single file held in memory before they are spilled to disk, 0 uses the default.")
+	rootCmd.AddCommand(diffCmd)
 
-	fmt.Println("Input file", internal.InputFile)
-	fmt.Println("Output file", internal.OutputFile)
-	fmt.Println("Chunk foler", internal.ChunkFolder)
 	cobra.CheckErr(rootCmd.Execute())
 }
 
 func rootRun(cmd *cobra.Command, args []string) error {
 	start := time.Now()
-	inputPath := internal.InputFile
-	// open a file
-	f, err := os.Open(inputPath)
+	// stdout is kept for the sorted rows
+	fmt.Fprintln(os.Stderr, "Input file", internal.InputFile)
+	fmt.Fprintln(os.Stderr, "Output file", internal.OutputFile)
+	fmt.Fprintln(os.Stderr, "Chunk folder", internal.ChunkFolder)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	chunkDirs, err := internal.ParseChunkDirs(internal.ChunkFolder)
+	if err != nil {
+		return err
+	}
+	placement, err := internal.ParsePlacement(internal.ChunkPlacement)
+	if err != nil {
+		return err
+	}
+	memoryBudget, err := internal.ParseSize(internal.MemoryBudget)
+	if err != nil {
+		return err
+	}
+	inMemorySize, err := internal.ParseSize(internal.InMemorySize)
+	if err != nil {
+		return err
+	}
+	maxRecordSize, err := internal.ParseSize(internal.MaxRecordSize)
+	if err != nil {
+		return err
+	}
+	rowPolicy, err := internal.ParseRowPolicy(internal.BadRows)
+	if err != nil {
+		return err
+	}
+	progress, err := internal.ParseProgress(internal.Progress)
+	if err != nil {
+		return err
+	}
+	rowFraming, err := framing.Parse(internal.Framing)
+	if err != nil {
+		return err
+	}
+	var metrics file.Metrics
+	if internal.MetricsAddr != "" {
+		promMetrics := file.NewPrometheusMetrics()
+		server, err := internal.ServeMetrics(internal.MetricsAddr, promMetrics)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		metrics = promMetrics
+	}
+	reducer, err := internal.ParseReducer(internal.Reduce)
+	if err != nil {
+		return err
+	}
+	partitionSize, err := internal.ParseSize(internal.PartitionSize)
+	if err != nil {
+		return err
+	}
+	inputs, client, err := openInputs()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if client != nil {
+		defer client.Close()
+	}
+	if internal.SFTPOutput && client == nil {
+		return fmt.Errorf("--%s needs --%s", internal.SFTPOutputName, internal.SFTPAddrName)
+	}
+	if internal.SFTPOutput && internal.GroupByKey {
+		return fmt.Errorf("--%s can not be used with --%s, the groups are written to local files", internal.SFTPOutputName, internal.GroupByKeyName)
+	}
+	// a single local input can be resumed
+	inputPath := ""
+	if len(inputs) == 1 && internal.SFTPAddr == "" {
+		inputPath = inputs[0].Name
+	}
+	allocateKey := func(line string) (key.Key, error) {
+		return key.AllocateTsv(line, 0)
+	}
+	keySpec := "tsv:0"
+	if internal.Reverse {
+		allocateKey = key.AllocateReverse(allocateKey)
+		keySpec += ":reverse"
+	}
 	fI := &file.Info{
-		Reader: f,
-		Allocate: vector.DefaultVector(func(line string) (key.Key, error) {
-			return key.AllocateTsv(line, 0)
-		}),
-		OutputPath:    internal.OutputFile,
-		PrintMemUsage: false,
+		Inputs:         inputs,
+		SourceColumn:   internal.SourceColumn,
+		Allocate:       vector.DefaultVector(allocateKey),
+		OutputPath:     internal.OutputFile,
+		PrintMemUsage:  internal.StatsFile != "",
+		SyncChunks:     internal.SyncChunks,
+		Resume:         internal.Resume,
+		InputPath:      inputPath,
+		KeySpec:        keySpec,
+		Placement:      placement,
+		ReadAhead:      internal.ReadAhead,
+		MemoryBudget:   memoryBudget,
+		InMemorySize:   inMemorySize,
+		MaxRecordSize:  int(maxRecordSize),
+		MergeWorkers:   internal.MergeWorkers,
+		CascadeFactor:  internal.CascadeFactor,
+		Stable:         internal.Stable,
+		Limit:          internal.Limit,
+		RowPolicy:      rowPolicy,
+		QuarantinePath: internal.QuarantinePath,
+		MaxErrors:      internal.MaxErrors,
+		Progress:       progress,
+		Metrics:        metrics,
+		Framing:        rowFraming,
+		Reduce:         reducer,
+		Combine:        internal.Combine,
+	}
+	// the key is the first column
+	keyText := func(line string) (string, error) {
+		return strings.SplitN(line, "\t", 2)[0], nil
+	}
+	if internal.PartitionRows > 0 || partitionSize > 0 || internal.Partitions > 0 {
+		fI.Partitioning = &file.Partitioning{
+			Rows:    internal.PartitionRows,
+			Size:    partitionSize,
+			Parts:   internal.Partitions,
+			KeyText: keyText,
+		}
+	}
+	if internal.GroupByKey {
+		fI.GroupBy = keyText
+		fI.GroupExtension = internal.GroupExtension
+	}
+	if internal.SFTPOutput {
+		fI.OpenOutput = client.OpenOutput
 	}
 
 	// create small files with maximum 30 rows in each
-	chunkPaths, err := fI.CreateSortedChunks(context.Background(), internal.ChunkFolder, internal.ChunkSize, internal.MaxWorkers)
+	chunkPaths, err := fI.CreateSortedChunks(ctx, chunkDirs, internal.ChunkSize, internal.MaxWorkers)
 	if err != nil {
 		return err
 	}
 	// perform a merge sort on all the chunks files.
 	// we sort using a buffer so we don't have to load the entire chunks when merging
-	err = fI.MergeSort(chunkPaths, internal.OutputBufferSize)
+	err = fI.MergeSort(ctx, chunkPaths, internal.OutputBufferSize)
 	if err != nil {
 		return err
 	}
+	if internal.StatsFile != "" {
+		err = fI.Stats().WriteFile(internal.StatsFile)
+		if err != nil {
+			return err
+		}
+	}
+	if fI.BadRows() > 0 {
+		fmt.Fprintln(os.Stderr, "Bad rows", fI.BadRows())
+	}
 	elapsed := time.Since(start)
-	fmt.Println(elapsed)
+	fmt.Fprintln(os.Stderr, elapsed)
+	return nil
+}
+
+// openInputs returns the inputs matching the comma separated paths, on the SFTP server if one is set,
+// and the client connected to the server, nil for local inputs.
+func openInputs() ([]file.Input, *sftp.Client, error) {
+	patterns := strings.Split(internal.InputFile, ",")
+	if internal.SFTPAddr == "" {
+		inputs, err := file.FileInputs(patterns...)
+		return inputs, nil, err
+	}
+	client, err := sftp.NewSFTPClient(internal.SFTPAddr, internal.SFTPKey, internal.SFTPUser, internal.SFTPPassphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	inputs, err := client.Inputs(patterns...)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return inputs, client, nil
+}
+
+// tsvKey returns an allocator of the key in the column pos.
+func tsvKey(pos int) func(line string) (key.Key, error) {
+	return func(line string) (key.Key, error) {
+		return key.AllocateTsv(line, pos)
+	}
+}
+
+// sorterOptions returns the settings of the sorts of the subcommands.
+func sorterOptions() ([]file.Option, error) {
+	chunkDirs, err := internal.ParseChunkDirs(internal.ChunkFolder)
+	if err != nil {
+		return nil, err
+	}
+	rowFraming, err := framing.Parse(internal.Framing)
+	if err != nil {
+		return nil, err
+	}
+	progress, err := internal.ParseProgress(internal.Progress)
+	if err != nil {
+		return nil, err
+	}
+	maxRecordSize, err := internal.ParseSize(internal.MaxRecordSize)
+	if err != nil {
+		return nil, err
+	}
+	opts := []file.Option{file.WithFraming(rowFraming), file.WithReporter(progress), file.WithMaxRecordSize(int(maxRecordSize))}
+	if len(chunkDirs) > 0 {
+		opts = append(opts, file.WithTempDirs(chunkDirs...))
+	}
+	if internal.ChunkSize > 0 {
+		opts = append(opts, file.WithChunkSize(internal.ChunkSize))
+	}
+	if internal.OutputBufferSize > 0 {
+		opts = append(opts, file.WithBufferSize(internal.OutputBufferSize))
+	}
+	if internal.MaxWorkers > 0 {
+		opts = append(opts, file.WithWorkers(internal.MaxWorkers, internal.MergeWorkers))
+	}
+	if internal.GroupRows > 0 {
+		opts = append(opts, file.WithGroupRows(internal.GroupRows))
+	}
+	return opts, nil
+}
+
+func joinRun(cmd *cobra.Command, args []string) error {
+	start := time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	joinType, err := internal.ParseJoinType(internal.JoinType)
+	if err != nil {
+		return err
+	}
+	columns, err := internal.ParseJoinColumns(internal.JoinColumns)
+	if err != nil {
+		return err
+	}
+	opts, err := sorterOptions()
+	if err != nil {
+		return err
+	}
+	left, err := os.Open(internal.LeftPath)
+	if err != nil {
+		return err
+	}
+	defer left.Close()
+	right, err := os.Open(internal.RightPath)
+	if err != nil {
+		return err
+	}
+	defer right.Close()
+	out, err := file.CreateAtomicFile(internal.OutputFile)
+	if err != nil {
+		return err
+	}
+	joiner := file.NewJoiner(file.Join{
+		Type:      joinType,
+		LeftKey:   tsvKey(internal.LeftKey),
+		RightKey:  tsvKey(internal.RightKey),
+		Columns:   columns,
+		GroupRows: internal.GroupRows,
+	}, opts...)
+	err = joiner.Join(ctx, left, right, out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, time.Since(start))
+	return nil
+}
+
+func diffRun(cmd *cobra.Command, args []string) error {
+	start := time.Now()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	opts, err := sorterOptions()
+	if err != nil {
+		return err
+	}
+	left, err := os.Open(internal.LeftPath)
+	if err != nil {
+		return err
+	}
+	defer left.Close()
+	right, err := os.Open(internal.RightPath)
+	if err != nil {
+		return err
+	}
+	defer right.Close()
+	out, err := file.CreateAtomicFile(internal.OutputFile)
+	if err != nil {
+		return err
+	}
+	differ := file.NewDiffer(tsvKey(internal.LeftKey), tsvKey(internal.RightKey), opts...)
+	summary, err := differ.Diff(ctx, left, right, out)
+	if err != nil {
+		return err
+	}
+	// stdout is kept for the rows
+	err = json.NewEncoder(os.Stderr).Encode(summary)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, time.Since(start))
+	return nil
+}
+
+func cleanupRun(cmd *cobra.Command, args []string) error {
+	chunkDirs, err := internal.ParseChunkDirs(internal.ChunkFolder)
+	if err != nil {
+		return err
+	}
+	for _, chunkDir := range chunkDirs {
+		removed, err := file.CleanupJobs(chunkDir.Path, time.Duration(internal.CleanupAge)*time.Hour)
+		for _, jobDir := range removed {
+			fmt.Fprintln(os.Stderr, "Removed", jobDir)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -1,10 +1,13 @@
 package main_test
 
 import (
+	"bufio"
 	"context"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
+	"strconv"
 	"testing"
 
 	"github.com/askiada/external-sort/file"
@@ -25,11 +28,11 @@ func BenchmarkMergeSort(b *testing.B) {
 		Allocate:   vector.DefaultVector(key.AllocateInt),
 		OutputPath: "testdata/chunks/output.tsv",
 	}
-	chunkPaths, err := fI.CreateSortedChunks(context.Background(), "testdata/chunks", chunkSize, 100)
+	chunkPaths, err := fI.CreateSortedChunks(context.Background(), file.ChunkDirs("testdata/chunks"), chunkSize, 100)
 	assert.NoError(b, err)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		err = fI.MergeSort(chunkPaths, bufferSize)
+		err = fI.MergeSort(context.Background(), chunkPaths, bufferSize)
 		_ = err
 	}
 	f.Close()
@@ -40,3 +43,42 @@ func BenchmarkMergeSort(b *testing.B) {
 		assert.NoError(b, err)
 	}
 }
+
+// BenchmarkMergeSortManyChunks Merge 200 chunks of random integers with and without read-ahead.
+func BenchmarkMergeSortManyChunks(b *testing.B) {
+	dir := b.TempDir()
+	filename := path.Join(dir, "input.tsv")
+	f, err := os.Create(filename)
+	assert.NoError(b, err)
+	w := bufio.NewWriter(f)
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 200000; i++ {
+		_, err = w.WriteString(strconv.Itoa(r.Int()) + "\n")
+		assert.NoError(b, err)
+	}
+	assert.NoError(b, w.Flush())
+	assert.NoError(b, f.Close())
+
+	for _, readAhead := range []bool{false, true} {
+		readAhead := readAhead
+		b.Run("read_ahead_"+strconv.FormatBool(readAhead), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				f, err := os.Open(filename)
+				assert.NoError(b, err)
+				fI := &file.Info{
+					Reader:     f,
+					Allocate:   vector.DefaultVector(key.AllocateInt),
+					OutputPath: path.Join(dir, "output.tsv"),
+					ReadAhead:  readAhead,
+				}
+				chunkPaths, err := fI.CreateSortedChunks(context.Background(), file.ChunkDirs(path.Join(dir, "chunks")), 1000, 4)
+				assert.NoError(b, err)
+				f.Close()
+				b.StartTimer()
+				err = fI.MergeSort(context.Background(), chunkPaths, 100)
+				assert.NoError(b, err)
+			}
+		})
+	}
+}
@@ -2,18 +2,34 @@ package main_test
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http/httptest"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/askiada/external-sort/file"
+	"github.com/askiada/external-sort/file/chunkfile"
+	"github.com/askiada/external-sort/file/framing"
+	"github.com/askiada/external-sort/internal"
+	xsftp "github.com/askiada/external-sort/sftp"
 	"github.com/askiada/external-sort/vector"
 	"github.com/askiada/external-sort/vector/key"
 
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,7 +43,7 @@ func prepareChunks(ctx context.Context, t *testing.T, allocate *vector.Allocate,
 		Allocate:   allocate,
 		OutputPath: outputFilename,
 	}
-	chunkPaths, err := fI.CreateSortedChunks(ctx, "testdata/chunks", chunkSize, 10)
+	chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs("testdata/chunks"), chunkSize, 10)
 	assert.NoError(t, err)
 
 	t.Cleanup(func() {
@@ -79,7 +95,7 @@ func TestBasics(t *testing.T) {
 					ctx := context.Background()
 					fI, chunkPaths := prepareChunks(ctx, t, allocate, filename, outputFilename, chunkSize)
 					fI.OutputPath = outputFilename
-					err := fI.MergeSort(chunkPaths, bufferSize)
+					err := fI.MergeSort(ctx, chunkPaths, bufferSize)
 					assert.NoError(t, err)
 					outputFile, err := os.Open(outputFilename)
 					assert.NoError(t, err)
@@ -121,7 +137,7 @@ func Test100Elems(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			ctx := context.Background()
 			fI, chunkPaths := prepareChunks(ctx, t, allocate, filename, outputFilename, 21)
-			err := fI.MergeSort(chunkPaths, 10)
+			err := fI.MergeSort(ctx, chunkPaths, 10)
 			assert.NoError(t, err)
 			outputFile, err := os.Open(outputFilename)
 			assert.NoError(t, err)
@@ -172,7 +188,7 @@ func TestTsvKey(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			ctx := context.Background()
 			fI, chunkPaths := prepareChunks(ctx, t, allocate, filename, outputFilename, 21)
-			err := fI.MergeSort(chunkPaths, 10)
+			err := fI.MergeSort(ctx, chunkPaths, 10)
 			assert.NoError(t, err)
 			outputFile, err := os.Open(outputFilename)
 			assert.NoError(t, err)
@@ -189,3 +205,1691 @@ func TestTsvKey(t *testing.T) {
 		})
 	}
 }
+
+func TestAtomicOutput(t *testing.T) {
+	dir := t.TempDir()
+	chunkPath := path.Join(dir, "chunk_1.tsv")
+	w, err := chunkfile.Create(chunkPath, false)
+	assert.NoError(t, err)
+	assert.NoError(t, w.WriteRow("1"))
+	assert.NoError(t, w.WriteRow("not a number"))
+	_, err = w.Close()
+	assert.NoError(t, err)
+
+	outputFilename := path.Join(dir, "output.tsv")
+	fI := &file.Info{
+		Allocate:   vector.DefaultVector(key.AllocateInt),
+		OutputPath: outputFilename,
+	}
+	err = fI.MergeSort(context.Background(), []string{chunkPath}, 1)
+	assert.Error(t, err)
+	_, err = os.Stat(outputFilename)
+	assert.True(t, os.IsNotExist(err))
+	dirEntries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, dirEntries, 1)
+}
+
+func TestCorruptedChunk(t *testing.T) {
+	tcs := map[string]func(t *testing.T, chunkPath string){
+		"truncated": func(t *testing.T, chunkPath string) {
+			assert.NoError(t, os.Truncate(chunkPath, 3))
+		},
+		"flipped byte": func(t *testing.T, chunkPath string) {
+			f, err := os.OpenFile(chunkPath, os.O_WRONLY, 0o644)
+			assert.NoError(t, err)
+			_, err = f.WriteAt([]byte("9"), 0)
+			assert.NoError(t, err)
+			assert.NoError(t, f.Close())
+		},
+	}
+	for name, corrupt := range tcs {
+		corrupt := corrupt
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			chunkPath := path.Join(dir, "chunk_1.tsv")
+			w, err := chunkfile.Create(chunkPath, true)
+			assert.NoError(t, err)
+			for _, line := range []string{"1", "2", "3"} {
+				assert.NoError(t, w.WriteRow(line))
+			}
+			footer, err := w.Close()
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(3), footer.Rows)
+			corrupt(t, chunkPath)
+
+			fI := &file.Info{
+				Allocate:   vector.DefaultVector(key.AllocateInt),
+				OutputPath: path.Join(dir, "output.tsv"),
+			}
+			err = fI.MergeSort(context.Background(), []string{chunkPath}, 10)
+			assert.Error(t, err)
+		})
+	}
+
+	// the sections merged in parallel are verified against the chunk indexes
+	input := ""
+	for i := 0; i < 40000; i++ {
+		input += strconv.Itoa((i*7919)%40000) + "\n"
+	}
+	for _, mergeWorkers := range []int{1, 2} {
+		mergeWorkers := mergeWorkers
+		t.Run("section_"+strconv.Itoa(mergeWorkers), func(t *testing.T) {
+			dir := t.TempDir()
+			fI := &file.Info{
+				Reader:       strings.NewReader(input),
+				Allocate:     vector.DefaultVector(key.AllocateInt),
+				OutputPath:   path.Join(dir, "output.tsv"),
+				MergeWorkers: mergeWorkers,
+			}
+			chunkPaths, err := fI.CreateSortedChunks(context.Background(), file.ChunkDirs(dir), 20000, 2)
+			assert.NoError(t, err)
+			assert.Len(t, chunkPaths, 2)
+			// change a digit in the middle of the rows, the chunk keeps its size
+			b, err := os.ReadFile(chunkPaths[0])
+			assert.NoError(t, err)
+			i := len(b) / 4
+			for b[i] == '\n' {
+				i++
+			}
+			b[i] = '0' + (b[i]-'0'+1)%10
+			assert.NoError(t, os.WriteFile(chunkPaths[0], b, 0o644))
+			err = fI.MergeSort(context.Background(), chunkPaths, 10)
+			assert.Error(t, err)
+			_, err = os.Stat(fI.OutputPath)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestJobFolders(t *testing.T) {
+	ctx := context.Background()
+	chunkFolder := t.TempDir()
+	allocate := vector.DefaultVector(key.AllocateInt)
+	infos := make([]*file.Info, 2)
+	chunkPaths := make([][]string, 2)
+	for i := range infos {
+		f, err := os.Open("testdata/100elems.tsv")
+		assert.NoError(t, err)
+		defer f.Close()
+		infos[i] = &file.Info{
+			Reader:     f,
+			Allocate:   allocate,
+			OutputPath: path.Join(chunkFolder, "output_"+strconv.Itoa(i)+".tsv"),
+		}
+		chunkPaths[i], err = infos[i].CreateSortedChunks(ctx, file.ChunkDirs(chunkFolder), 21, 2)
+		assert.NoError(t, err)
+	}
+	assert.NotEqual(t, path.Dir(chunkPaths[0][0]), path.Dir(chunkPaths[1][0]))
+
+	// active jobs are kept
+	removed, err := file.CleanupJobs(chunkFolder, time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+
+	// the first job completes and removes its folder
+	assert.NoError(t, infos[0].MergeSort(ctx, chunkPaths[0], 10))
+	_, err = os.Stat(path.Dir(chunkPaths[0][0]))
+	assert.True(t, os.IsNotExist(err))
+
+	// the second job looks orphaned but still holds its lock
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(path.Join(path.Dir(chunkPaths[1][0]), "job.lock"), old, old))
+	removed, err = file.CleanupJobs(chunkFolder, time.Hour)
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	removed, err = file.CleanupJobs(chunkFolder, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+
+	// the folder of a crashed job is removed
+	crashed := path.Join(chunkFolder, "job-crashed")
+	assert.NoError(t, os.MkdirAll(path.Join(crashed, "chunks"), 0o755))
+	assert.NoError(t, os.WriteFile(path.Join(crashed, "job.lock"), nil, 0o644))
+	assert.NoError(t, os.Chtimes(path.Join(crashed, "job.lock"), old, old))
+	removed, err = file.CleanupJobs(chunkFolder, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{crashed}, removed)
+	_, err = os.Stat(crashed)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, infos[1].Cleanup())
+	_, err = os.Stat(path.Dir(chunkPaths[1][0]))
+	assert.True(t, os.IsNotExist(err))
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("input should not be read")
+}
+
+func TestResume(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	chunkFolder := path.Join(dir, "chunks")
+	outputFilename := path.Join(dir, "output.tsv")
+	allocate := vector.DefaultVector(key.AllocateInt)
+
+	f, err := os.Open("testdata/100elems.tsv")
+	assert.NoError(t, err)
+	defer f.Close()
+	fI := &file.Info{
+		Reader:     f,
+		Allocate:   allocate,
+		OutputPath: outputFilename,
+		Resume:     true,
+		InputPath:  "testdata/100elems.tsv",
+		KeySpec:    "int",
+		OpenOutput: func(string) (file.AtomicWriter, error) {
+			return nil, errors.New("output unavailable")
+		},
+	}
+	chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(chunkFolder), 21, 2)
+	assert.NoError(t, err)
+
+	// the job is locked until the merge is done
+	running := &file.Info{
+		Reader:     failingReader{},
+		Allocate:   allocate,
+		OutputPath: outputFilename,
+		Resume:     true,
+		InputPath:  "testdata/100elems.tsv",
+		KeySpec:    "int",
+	}
+	_, err = running.CreateSortedChunks(ctx, file.ChunkDirs(chunkFolder), 21, 2)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already running")
+
+	assert.Error(t, fI.MergeSort(ctx, chunkPaths, 10))
+	for _, chunkPath := range chunkPaths {
+		assert.FileExists(t, chunkPath)
+	}
+
+	// the chunks are not resumed with other chunk folders
+	fI = &file.Info{
+		Reader:     failingReader{},
+		Allocate:   allocate,
+		OutputPath: outputFilename,
+		Resume:     true,
+		InputPath:  "testdata/100elems.tsv",
+		KeySpec:    "int",
+	}
+	_, err = fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "other"), chunkFolder), 21, 2)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "input should not be read")
+
+	// nor with settings changing the rows of the chunks
+	for name, change := range map[string]func(fI *file.Info){
+		"reduce":          func(fI *file.Info) { fI.Reduce = file.Count{} },
+		"combine":         func(fI *file.Info) { fI.Reduce, fI.Combine = file.Count{}, true },
+		"stable":          func(fI *file.Info) { fI.Stable = true },
+		"source column":   func(fI *file.Info) { fI.SourceColumn = true },
+		"max record size": func(fI *file.Info) { fI.MaxRecordSize = 1 << 20 },
+	} {
+		fI = &file.Info{
+			Reader:     failingReader{},
+			Allocate:   allocate,
+			OutputPath: outputFilename,
+			Resume:     true,
+			InputPath:  "testdata/100elems.tsv",
+			KeySpec:    "int",
+		}
+		change(fI)
+		_, err = fI.CreateSortedChunks(ctx, file.ChunkDirs(chunkFolder), 21, 2)
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), "input should not be read", name)
+		}
+	}
+
+	fI = &file.Info{
+		Reader:     failingReader{},
+		Allocate:   allocate,
+		OutputPath: outputFilename,
+		Resume:     true,
+		InputPath:  "testdata/100elems.tsv",
+		KeySpec:    "int",
+	}
+	resumedPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(chunkFolder), 21, 2)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, chunkPaths, resumedPaths)
+	assert.NoError(t, fI.MergeSort(ctx, resumedPaths, 10))
+	output, err := os.ReadFile(outputFilename)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, strings.Count(string(output), "\n"))
+	_, err = os.Stat(path.Dir(chunkPaths[0]))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestChunkDirs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	allocate := vector.DefaultVector(key.AllocateInt)
+	// every chunk of 21 rows from 100elems.tsv takes less than 120 bytes
+	tcs := map[string]struct {
+		expectedErr bool
+		chunkDirs   []file.ChunkDir
+		expected    []int
+	}{
+		"round robin": {
+			chunkDirs: file.ChunkDirs(path.Join(dir, "a"), path.Join(dir, "b")),
+			expected:  []int{3, 2},
+		},
+		"quota fallback": {
+			chunkDirs: []file.ChunkDir{{Path: path.Join(dir, "c"), Quota: 120}, {Path: path.Join(dir, "d")}},
+			expected:  []int{1, 4},
+		},
+		"quota exceeded": {
+			chunkDirs:   []file.ChunkDir{{Path: path.Join(dir, "e"), Quota: 120}, {Path: path.Join(dir, "f"), Quota: 120}},
+			expectedErr: true,
+		},
+	}
+	for name, tc := range tcs {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open("testdata/100elems.tsv")
+			assert.NoError(t, err)
+			defer f.Close()
+			fI := &file.Info{
+				Reader:     f,
+				Allocate:   allocate,
+				OutputPath: path.Join(dir, name+".tsv"),
+			}
+			chunkPaths, err := fI.CreateSortedChunks(ctx, tc.chunkDirs, 21, 1)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for i, chunkDir := range tc.chunkDirs {
+				count := 0
+				for _, chunkPath := range chunkPaths {
+					if strings.HasPrefix(chunkPath, chunkDir.Path+"/") {
+						count++
+					}
+				}
+				assert.Equal(t, tc.expected[i], count)
+			}
+			assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+			output, err := os.ReadFile(fI.OutputPath)
+			assert.NoError(t, err)
+			assert.Equal(t, 100, strings.Count(string(output), "\n"))
+		})
+	}
+}
+
+func TestParseChunkDirs(t *testing.T) {
+	dirs, err := internal.ParseChunkDirs("/mnt/d1:100G, /mnt/d2,/mnt/a:b")
+	assert.NoError(t, err)
+	assert.Equal(t, []file.ChunkDir{{Path: "/mnt/d1", Quota: 100 << 30}, {Path: "/mnt/d2"}, {Path: "/mnt/a:b"}}, dirs)
+
+	_, err = internal.ParseChunkDirs("/mnt/d1:100X")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid size")
+}
+
+func TestReadAhead(t *testing.T) {
+	expectedOutput := []string{"3", "4", "5", "6", "6", "7", "7", "7", "8", "8", "9", "9", "10", "10", "15", "18", "18", "18", "18", "21", "22", "22", "25", "25", "25", "25", "25", "26", "26", "27", "27", "28", "28", "29", "29", "29", "30", "30", "31", "31", "33", "33", "34", "36", "37", "39", "39", "39", "40", "41", "41", "42", "43", "43", "47", "47", "49", "50", "50", "52", "52", "53", "54", "55", "55", "55", "56", "57", "57", "59", "60", "61", "62", "63", "67", "71", "71", "72", "72", "73", "74", "75", "78", "79", "80", "80", "82", "89", "89", "89", "91", "91", "92", "92", "93", "93", "94", "97", "97", "99"}
+	allocate := vector.DefaultVector(key.AllocateInt)
+	for _, memoryBudget := range []int64{0, 1, 200, 1 << 20} {
+		for _, chunkSize := range []int{1, 7, 21, 150} {
+			for _, bufferSize := range []int{1, 3, 10, 150} {
+				memoryBudget, chunkSize, bufferSize := memoryBudget, chunkSize, bufferSize
+				t.Run(strconv.FormatInt(memoryBudget, 10)+"_"+strconv.Itoa(chunkSize)+"_"+strconv.Itoa(bufferSize), func(t *testing.T) {
+					ctx := context.Background()
+					outputFilename := "testdata/chunks/output.tsv"
+					fI, chunkPaths := prepareChunks(ctx, t, allocate, "testdata/100elems.tsv", outputFilename, chunkSize)
+					fI.ReadAhead = true
+					fI.MemoryBudget = memoryBudget
+					err := fI.MergeSort(ctx, chunkPaths, bufferSize)
+					assert.NoError(t, err)
+					output, err := os.ReadFile(outputFilename)
+					assert.NoError(t, err)
+					assert.Equal(t, strings.Join(expectedOutput, "\n")+"\n", string(output))
+				})
+			}
+		}
+	}
+}
+
+type failingOutput struct {
+	aborted bool
+}
+
+func (o *failingOutput) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (o *failingOutput) Commit() error {
+	return errors.New("commit after a failed write")
+}
+
+func (o *failingOutput) Abort() error {
+	o.aborted = true
+	return nil
+}
+
+func TestOutputWriteError(t *testing.T) {
+	ctx := context.Background()
+	allocate := vector.DefaultVector(key.AllocateInt)
+	fI, chunkPaths := prepareChunks(ctx, t, allocate, "testdata/100elems.tsv", "testdata/chunks/output.tsv", 21)
+	output := &failingOutput{}
+	fI.OpenOutput = func(string) (file.AtomicWriter, error) {
+		return output, nil
+	}
+	err := fI.MergeSort(ctx, chunkPaths, 1)
+	assert.EqualError(t, err, "disk full")
+	assert.True(t, output.aborted)
+
+	// an output that can not be written at an offset is merged at once
+	fI, chunkPaths = prepareChunks(ctx, t, allocate, "testdata/100elems.tsv", "testdata/chunks/output.tsv", 21)
+	fI.MergeWorkers = 3
+	output = &failingOutput{}
+	fI.OpenOutput = func(string) (file.AtomicWriter, error) {
+		return output, nil
+	}
+	err = fI.MergeSort(ctx, chunkPaths, 1)
+	assert.EqualError(t, err, "disk full")
+	assert.True(t, output.aborted)
+
+	// any other output is written at the offsets of the ranges
+	fI, chunkPaths = prepareChunks(ctx, t, allocate, "testdata/100elems.tsv", "testdata/chunks/output.tsv", 21)
+	fI.MergeWorkers = 3
+	outputAt := &failingOutputAt{}
+	fI.OpenOutput = func(string) (file.AtomicWriter, error) {
+		return outputAt, nil
+	}
+	err = fI.MergeSort(ctx, chunkPaths, 1)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "disk full at offset")
+	assert.True(t, outputAt.aborted)
+}
+
+type failingOutputAt struct {
+	failingOutput
+}
+
+func (o *failingOutputAt) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("disk full at offset")
+}
+
+func TestParallelMerge(t *testing.T) {
+	ctx := context.Background()
+	allocate := vector.DefaultVector(key.AllocateInt)
+	inputFilename := path.Join(t.TempDir(), "input.tsv")
+	input, err := os.Create(inputFilename)
+	assert.NoError(t, err)
+	rows := make([]int, 5000)
+	for i := range rows {
+		// many equal keys so ranges are split in the middle of duplicates
+		rows[i] = (i * 7919) % 613
+		_, err = input.WriteString(strconv.Itoa(rows[i]) + "\n")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, input.Close())
+	sort.Ints(rows)
+	expectedOutput := ""
+	for _, row := range rows {
+		expectedOutput += strconv.Itoa(row) + "\n"
+	}
+	for _, workers := range []int{2, 3, 8, 64} {
+		for _, chunkSize := range []int{1, 300, 1200, 5000} {
+			workers, chunkSize := workers, chunkSize
+			t.Run(strconv.Itoa(workers)+"_"+strconv.Itoa(chunkSize), func(t *testing.T) {
+				outputFilename := "testdata/chunks/output.tsv"
+				fI, chunkPaths := prepareChunks(ctx, t, allocate, inputFilename, outputFilename, chunkSize)
+				fI.MergeWorkers = workers
+				fI.ReadAhead = workers%2 == 0
+				err := fI.MergeSort(ctx, chunkPaths, 10)
+				assert.NoError(t, err)
+				output, err := os.ReadFile(outputFilename)
+				assert.NoError(t, err)
+				assert.Equal(t, expectedOutput, string(output))
+			})
+		}
+	}
+}
+
+func TestCascade(t *testing.T) {
+	expectedOutput := []string{"3", "4", "5", "6", "6", "7", "7", "7", "8", "8", "9", "9", "10", "10", "15", "18", "18", "18", "18", "21", "22", "22", "25", "25", "25", "25", "25", "26", "26", "27", "27", "28", "28", "29", "29", "29", "30", "30", "31", "31", "33", "33", "34", "36", "37", "39", "39", "39", "40", "41", "41", "42", "43", "43", "47", "47", "49", "50", "50", "52", "52", "53", "54", "55", "55", "55", "56", "57", "57", "59", "60", "61", "62", "63", "67", "71", "71", "72", "72", "73", "74", "75", "78", "79", "80", "80", "82", "89", "89", "89", "91", "91", "92", "92", "93", "93", "94", "97", "97", "99"}
+	tcs := map[string]struct {
+		factor         int
+		chunkSize      int
+		expectedChunks int
+	}{
+		// 15 chunks is 1111 in base 2
+		"factor 2": {factor: 2, chunkSize: 7, expectedChunks: 4},
+		// 15 chunks is 120 in base 3
+		"factor 3": {factor: 3, chunkSize: 7, expectedChunks: 3},
+		// 100 chunks is 100 in base 10
+		"factor 10": {factor: 10, chunkSize: 1, expectedChunks: 1},
+		"disabled":  {factor: 1, chunkSize: 7, expectedChunks: 15},
+	}
+	allocate := vector.DefaultVector(key.AllocateInt)
+	for name, tc := range tcs {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			f, err := os.Open("testdata/100elems.tsv")
+			assert.NoError(t, err)
+			defer f.Close()
+			dir := t.TempDir()
+			fI := &file.Info{
+				Reader:        f,
+				Allocate:      allocate,
+				OutputPath:    path.Join(dir, "output.tsv"),
+				CascadeFactor: tc.factor,
+			}
+			chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(dir), tc.chunkSize, 4)
+			assert.NoError(t, err)
+			assert.Len(t, chunkPaths, tc.expectedChunks)
+			err = fI.MergeSort(ctx, chunkPaths, 10)
+			assert.NoError(t, err)
+			output, err := os.ReadFile(fI.OutputPath)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Join(expectedOutput, "\n")+"\n", string(output))
+		})
+	}
+}
+
+func TestStable(t *testing.T) {
+	ctx := context.Background()
+	rows := []string{}
+	for i := 0; i < 2000; i++ {
+		rows = append(rows, strconv.Itoa(i%3)+"\t"+strconv.Itoa(i))
+	}
+	expected := []string{}
+	for k := 0; k < 3; k++ {
+		for _, row := range rows {
+			if strings.HasPrefix(row, strconv.Itoa(k)+"\t") {
+				expected = append(expected, row)
+			}
+		}
+	}
+	allocate := vector.DefaultVector(func(line string) (key.Key, error) {
+		return key.AllocateTsv(line, 0)
+	})
+	// 40 chunks of 50 rows, merged at once, in several rounds or by key ranges
+	tcs := map[string]struct {
+		cascadeFactor int
+		mergeWorkers  int
+	}{
+		"single_merge":  {},
+		"cascade_merge": {cascadeFactor: 4},
+		"parallel":      {mergeWorkers: 3},
+	}
+	for name, tc := range tcs {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			inputFilename := path.Join(dir, "input.tsv")
+			assert.NoError(t, os.WriteFile(inputFilename, []byte(strings.Join(rows, "\n")+"\n"), 0o644))
+			f, err := os.Open(inputFilename)
+			assert.NoError(t, err)
+			defer f.Close()
+			fI := &file.Info{
+				Reader:        f,
+				Allocate:      allocate,
+				OutputPath:    path.Join(dir, "output.tsv"),
+				Stable:        true,
+				CascadeFactor: tc.cascadeFactor,
+				MergeWorkers:  tc.mergeWorkers,
+			}
+			chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 50, 4)
+			assert.NoError(t, err)
+			if tc.cascadeFactor == 0 {
+				assert.Len(t, chunkPaths, 40)
+			}
+			assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+			output, err := os.ReadFile(fI.OutputPath)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Join(expected, "\n")+"\n", string(output))
+		})
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	ctx := context.Background()
+	allocate := vector.DefaultVector(key.AllocateInt)
+	outputs := map[string]string{}
+	// 100 rows fit in a chunk of 100 rows but not in a chunk of 99 rows
+	tcs := map[string]struct {
+		chunkSize    int
+		memoryBudget int64
+		inMemorySize int64
+		inMemory     bool
+	}{
+		"99":                {chunkSize: 99},
+		"100":               {chunkSize: 100, inMemory: true},
+		"1000":              {chunkSize: 1000, inMemory: true},
+		"99_memory_budget":  {chunkSize: 99, memoryBudget: 1 << 20},
+		"99_in_memory_size": {chunkSize: 99, inMemorySize: 1 << 20, inMemory: true},
+	}
+	for name, tc := range tcs {
+		dir := t.TempDir()
+		chunkFolder := path.Join(dir, "chunks")
+		f, err := os.Open("testdata/100elems.tsv")
+		assert.NoError(t, err)
+		fI := &file.Info{
+			Reader:       f,
+			Allocate:     allocate,
+			OutputPath:   path.Join(dir, "output.tsv"),
+			MemoryBudget: tc.memoryBudget,
+			InMemorySize: tc.inMemorySize,
+		}
+		chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(chunkFolder), tc.chunkSize, 2)
+		assert.NoError(t, err)
+		_, err = os.Stat(chunkFolder)
+		if tc.inMemory {
+			assert.Empty(t, chunkPaths, name)
+			assert.True(t, os.IsNotExist(err), name)
+		} else {
+			assert.Len(t, chunkPaths, 2, name)
+			assert.NoError(t, err, name)
+		}
+		assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+		f.Close()
+		output, err := os.ReadFile(fI.OutputPath)
+		assert.NoError(t, err)
+		outputs[name] = string(output)
+	}
+	for name := range tcs {
+		assert.Equal(t, outputs["99"], outputs[name], name)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	sorted := []string{"3", "4", "5", "6", "6", "7", "7", "7", "8", "8", "9", "9", "10", "10", "15", "18", "18", "18", "18", "21", "22", "22", "25", "25", "25", "25", "25", "26", "26", "27", "27", "28", "28", "29", "29", "29", "30", "30", "31", "31", "33", "33", "34", "36", "37", "39", "39", "39", "40", "41", "41", "42", "43", "43", "47", "47", "49", "50", "50", "52", "52", "53", "54", "55", "55", "55", "56", "57", "57", "59", "60", "61", "62", "63", "67", "71", "71", "72", "72", "73", "74", "75", "78", "79", "80", "80", "82", "89", "89", "89", "91", "91", "92", "92", "93", "93", "94", "97", "97", "99"}
+	reversed := make([]string, 0, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		reversed = append(reversed, sorted[i])
+	}
+	for _, reverse := range []bool{false, true} {
+		// limits up to the chunk size use the heap, larger ones the chunks
+		for _, limit := range []int{1, 5, 20, 21, 50, 100, 150} {
+			reverse, limit := reverse, limit
+			t.Run(strconv.FormatBool(reverse)+"_"+strconv.Itoa(limit), func(t *testing.T) {
+				ctx := context.Background()
+				allocateKey := key.AllocateInt
+				expected := sorted
+				if reverse {
+					allocateKey = key.AllocateReverse(allocateKey)
+					expected = reversed
+				}
+				if limit < len(expected) {
+					expected = expected[:limit]
+				}
+				dir := t.TempDir()
+				f, err := os.Open("testdata/100elems.tsv")
+				assert.NoError(t, err)
+				defer f.Close()
+				fI := &file.Info{
+					Reader:        f,
+					Allocate:      vector.DefaultVector(allocateKey),
+					OutputPath:    path.Join(dir, "output.tsv"),
+					Limit:         limit,
+					CascadeFactor: 2,
+				}
+				chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 20, 2)
+				assert.NoError(t, err)
+				if limit <= 20 {
+					assert.Empty(t, chunkPaths)
+				}
+				assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 3))
+				output, err := os.ReadFile(fI.OutputPath)
+				assert.NoError(t, err)
+				assert.Equal(t, strings.Join(expected, "\n")+"\n", string(output))
+			})
+		}
+	}
+}
+
+func TestBadRows(t *testing.T) {
+	input := "5\n12\nx\n3\r\n\n7\n1y\n2\n"
+	tcs := map[string]struct {
+		policy         file.RowPolicy
+		maxErrors      int
+		limit          int
+		reduce         bool
+		expectedErr    string
+		expectedOutput string
+		expectedBad    int
+	}{
+		"fail": {
+			policy:      file.FailOnBadRow,
+			expectedErr: `line 3 (byte 5): strconv.Atoi: parsing "x": invalid syntax`,
+		},
+		"skip": {
+			policy:         file.SkipBadRows,
+			expectedOutput: "2\n3\n5\n7\n12\n",
+			expectedBad:    3,
+		},
+		"quarantine": {
+			policy:         file.QuarantineBadRows,
+			expectedOutput: "2\n3\n5\n7\n12\n",
+			expectedBad:    3,
+		},
+		// the input rows are quarantined, not their partial results
+		"quarantine reduced": {
+			policy:         file.QuarantineBadRows,
+			reduce:         true,
+			expectedOutput: "2\t1\n3\t1\n5\t1\n7\t1\n12\t1\n",
+			expectedBad:    3,
+		},
+		"limit": {
+			policy:         file.SkipBadRows,
+			limit:          2,
+			expectedOutput: "2\n3\n",
+			expectedBad:    3,
+		},
+		"too many errors": {
+			policy:      file.SkipBadRows,
+			maxErrors:   2,
+			expectedErr: `more than 2 bad rows: line 7 (byte 13): strconv.Atoi: parsing "1y": invalid syntax`,
+		},
+	}
+	for name, tc := range tcs {
+		tc := tc
+		// chunks of 2 rows are written on disk, 100 rows are sorted in memory
+		for _, chunkSize := range []int{2, 100} {
+			chunkSize := chunkSize
+			t.Run(name+"_"+strconv.Itoa(chunkSize), func(t *testing.T) {
+				ctx := context.Background()
+				dir := t.TempDir()
+				fI := &file.Info{
+					Reader:         strings.NewReader(input),
+					Allocate:       vector.DefaultVector(key.AllocateInt),
+					OutputPath:     path.Join(dir, "output.tsv"),
+					RowPolicy:      tc.policy,
+					QuarantinePath: path.Join(dir, "quarantine.tsv"),
+					MaxErrors:      tc.maxErrors,
+					Limit:          tc.limit,
+				}
+				if tc.reduce {
+					fI.Reduce = file.Count{}
+					fI.Allocate = vector.DefaultVector(func(line string) (key.Key, error) {
+						return key.AllocateInt(strings.SplitN(line, "\t", 2)[0])
+					})
+				}
+				chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), chunkSize, 1)
+				if tc.expectedErr != "" {
+					assert.Error(t, err)
+					assert.Contains(t, err.Error(), tc.expectedErr)
+					return
+				}
+				assert.NoError(t, err)
+				assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+				output, err := os.ReadFile(fI.OutputPath)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expectedOutput, string(output))
+				assert.Equal(t, tc.expectedBad, fI.BadRows())
+				quarantine, err := os.ReadFile(fI.QuarantinePath)
+				if tc.policy == file.QuarantineBadRows {
+					assert.NoError(t, err)
+					lines := strings.Split(strings.TrimSuffix(string(quarantine), "\n"), "\n")
+					assert.ElementsMatch(t, []string{"x", "", "1y"}, lines)
+				} else {
+					assert.True(t, os.IsNotExist(err))
+				}
+			})
+		}
+	}
+}
+
+func TestBadRowsCascade(t *testing.T) {
+	ctx := context.Background()
+	// the first batch only holds bad rows
+	input := strings.Repeat("x\n", 10)
+	expected := []string{}
+	for i := 0; i < 30; i++ {
+		input += fmt.Sprintf("%d\n", i)
+		expected = append(expected, strconv.Itoa(i))
+	}
+	for _, factor := range []int{0, 2} {
+		dir := t.TempDir()
+		fI := &file.Info{
+			Reader:        strings.NewReader(input),
+			Allocate:      vector.DefaultVector(key.AllocateInt),
+			OutputPath:    path.Join(dir, "output.tsv"),
+			RowPolicy:     file.SkipBadRows,
+			CascadeFactor: factor,
+		}
+		chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 10, 2)
+		assert.NoError(t, err)
+		assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 3))
+		output, err := os.ReadFile(fI.OutputPath)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.Join(expected, "\n")+"\n", string(output), "factor %d", factor)
+		assert.Equal(t, 10, fI.BadRows())
+	}
+}
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	input, err := os.Stat("testdata/100elems.tsv")
+	assert.NoError(t, err)
+	for _, chunkSize := range []int{21, 100} {
+		chunkSize := chunkSize
+		t.Run(strconv.Itoa(chunkSize), func(t *testing.T) {
+			dir := t.TempDir()
+			f, err := os.Open("testdata/100elems.tsv")
+			assert.NoError(t, err)
+			defer f.Close()
+			fI := &file.Info{
+				Reader:        f,
+				Allocate:      vector.DefaultVector(key.AllocateInt),
+				OutputPath:    path.Join(dir, "output.tsv"),
+				KeySpec:       "int",
+				PrintMemUsage: true,
+			}
+			chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), chunkSize, 2)
+			assert.NoError(t, err)
+			chunkBytes := int64(0)
+			for _, chunkPath := range chunkPaths {
+				info, err := os.Stat(chunkPath)
+				assert.NoError(t, err)
+				chunkBytes += info.Size()
+			}
+			assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+			output, err := os.Stat(fI.OutputPath)
+			assert.NoError(t, err)
+
+			stats := fI.Stats()
+			assert.Equal(t, "int", stats.KeySpec)
+			assert.Equal(t, int64(100), stats.RowsRead)
+			assert.Equal(t, int64(100), stats.RowsWritten)
+			assert.Equal(t, input.Size(), stats.BytesRead)
+			assert.Equal(t, output.Size(), stats.BytesWritten)
+			assert.Equal(t, len(chunkPaths), stats.Chunks.Count)
+			assert.Equal(t, chunkBytes, stats.Chunks.Bytes)
+			assert.Equal(t, chunkSize == 100, stats.InMemory)
+			assert.NotNil(t, stats.Memory)
+			assert.True(t, stats.Durations.Total >= stats.Durations.Merge)
+
+			statsFile := path.Join(dir, "stats.json")
+			assert.NoError(t, stats.WriteFile(statsFile))
+			content, err := os.ReadFile(statsFile)
+			assert.NoError(t, err)
+			assert.Contains(t, string(content), `"key_spec": "int"`)
+			assert.Contains(t, string(content), `"rows_written": 100`)
+		})
+	}
+}
+
+// recordProgress Keep the events and the progress of every phase.
+type recordProgress struct {
+	mu       sync.Mutex
+	events   []string
+	totals   map[file.Phase]int64
+	advanced map[file.Phase]int64
+}
+
+func (r *recordProgress) Start(phase file.Phase, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "start "+string(phase))
+	r.totals[phase] = total
+}
+
+func (r *recordProgress) Advance(phase file.Phase, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advanced[phase] += n
+}
+
+func (r *recordProgress) Finish(phase file.Phase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, "finish "+string(phase))
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	input, err := os.Stat("testdata/100elems.tsv")
+	assert.NoError(t, err)
+	for _, mergeWorkers := range []int{1, 3} {
+		mergeWorkers := mergeWorkers
+		t.Run(strconv.Itoa(mergeWorkers), func(t *testing.T) {
+			dir := t.TempDir()
+			f, err := os.Open("testdata/100elems.tsv")
+			assert.NoError(t, err)
+			defer f.Close()
+			progress := &recordProgress{totals: map[file.Phase]int64{}, advanced: map[file.Phase]int64{}}
+			fI := &file.Info{
+				Reader:       f,
+				Allocate:     vector.DefaultVector(key.AllocateInt),
+				OutputPath:   path.Join(dir, "output.tsv"),
+				MergeWorkers: mergeWorkers,
+				Progress:     progress,
+			}
+			chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 21, 2)
+			assert.NoError(t, err)
+			assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+
+			assert.Equal(t, []string{"start chunking", "finish chunking", "start merge", "finish merge"}, progress.events)
+			assert.Equal(t, input.Size(), progress.totals[file.PhaseChunking])
+			assert.Equal(t, input.Size(), progress.advanced[file.PhaseChunking])
+			assert.Equal(t, int64(100), progress.totals[file.PhaseMerge])
+			assert.Equal(t, int64(100), progress.advanced[file.PhaseMerge])
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f, err := os.Open("testdata/100elems.tsv")
+	assert.NoError(t, err)
+	defer f.Close()
+	metrics := file.NewPrometheusMetrics()
+	fI := &file.Info{
+		Reader:     f,
+		Allocate:   vector.DefaultVector(key.AllocateInt),
+		OutputPath: path.Join(dir, "output.tsv"),
+		Metrics:    metrics,
+	}
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 21, 2)
+	assert.NoError(t, err)
+	chunkBytes := int64(0)
+	for _, chunkPath := range chunkPaths {
+		info, err := os.Stat(chunkPath)
+		assert.NoError(t, err)
+		chunkBytes += info.Size()
+	}
+	body := scrape()
+	assert.Contains(t, body, "# TYPE external_sort_rows_scanned_total counter\nexternal_sort_rows_scanned_total 100\n")
+	assert.Contains(t, body, "external_sort_chunks_written_total "+strconv.Itoa(len(chunkPaths))+"\n")
+	assert.Contains(t, body, "external_sort_chunk_bytes "+strconv.FormatInt(chunkBytes, 10)+"\n")
+
+	assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+	body = scrape()
+	assert.Contains(t, body, "external_sort_merge_rows_total 100\n")
+	assert.Contains(t, body, "external_sort_open_chunk_files 0\n")
+	assert.Contains(t, body, "external_sort_chunk_bytes 0\n")
+	assert.NotContains(t, body, "external_sort_memory_sys_bytes 0\n")
+}
+
+func TestSorter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	input, err := os.ReadFile("testdata/100elems.tsv")
+	assert.NoError(t, err)
+	f, err := os.Open("testdata/100elems.tsv")
+	assert.NoError(t, err)
+	defer f.Close()
+	fI := &file.Info{
+		Reader:     f,
+		Allocate:   vector.DefaultVector(key.AllocateInt),
+		OutputPath: path.Join(dir, "expected.tsv"),
+	}
+	chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 21, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+	expected, err := os.ReadFile(fI.OutputPath)
+	assert.NoError(t, err)
+
+	for _, mergeWorkers := range []int{1, 3} {
+		sorter := file.NewSorter(
+			file.WithKey(key.AllocateInt),
+			file.WithChunkSize(21),
+			file.WithBufferSize(10),
+			file.WithWorkers(2, mergeWorkers),
+			file.WithTempDirs(file.ChunkDirs(path.Join(dir, "chunks"))...),
+		)
+		// the output is committed once sorted
+		outputPath := path.Join(dir, "output.tsv")
+		out, err := file.CreateAtomicFile(outputPath)
+		assert.NoError(t, err)
+		assert.NoError(t, sorter.Sort(ctx, bytes.NewReader(input), out))
+		output, err := os.ReadFile(outputPath)
+		assert.NoError(t, err)
+		assert.Equal(t, string(expected), string(output))
+
+		// a stream that can not be written at an offset is merged at once
+		buffer := &bytes.Buffer{}
+		assert.NoError(t, sorter.Sort(ctx, bytes.NewReader(input), buffer))
+		assert.Equal(t, string(expected), buffer.String())
+	}
+
+	// gzip input and output
+	compressed := &bytes.Buffer{}
+	zw := gzip.NewWriter(compressed)
+	_, err = zw.Write(input)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	sorter := file.NewSorter(
+		file.WithKey(key.AllocateInt),
+		file.WithChunkSize(21),
+		file.WithTempDirs(file.ChunkDirs(path.Join(dir, "chunks"))...),
+		file.WithInputCodec(file.GzipCodec{}),
+		file.WithOutputCodec(file.GzipCodec{}),
+	)
+	out := &bytes.Buffer{}
+	assert.NoError(t, sorter.Sort(ctx, compressed, out))
+	zr, err := gzip.NewReader(out)
+	assert.NoError(t, err)
+	output, err := ioutil.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(output))
+}
+
+type person struct {
+	Name string
+	Age  int
+}
+
+// jsonCodec Encode the persons as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Decode(data []byte) (interface{}, error) {
+	p := person{}
+	err := json.Unmarshal(data, &p)
+	return p, err
+}
+
+func TestValueSorter(t *testing.T) {
+	ctx := context.Background()
+	persons := []person{}
+	for i := 0; i < 200; i++ {
+		// names contain newlines, they can only be stored in binary chunks
+		persons = append(persons, person{Name: "name\n" + strconv.Itoa(i), Age: (i * 37) % 50})
+	}
+	less := func(a, b interface{}) bool {
+		pa, pb := a.(person), b.(person)
+		if pa.Age != pb.Age {
+			return pa.Age < pb.Age
+		}
+		return pa.Name < pb.Name
+	}
+	expected := make([]person, len(persons))
+	copy(expected, persons)
+	sort.Slice(expected, func(i, j int) bool {
+		return less(expected[i], expected[j])
+	})
+	for _, mergeWorkers := range []int{1, 3} {
+		sorter := file.NewValueSorter(jsonCodec{}, less,
+			file.WithChunkSize(16),
+			file.WithBufferSize(4),
+			file.WithWorkers(2, mergeWorkers),
+			file.WithTempDirs(file.ChunkDirs(t.TempDir())...),
+		)
+		i := 0
+		it := sorter.Sort(ctx, func() (interface{}, error) {
+			if i == len(persons) {
+				return nil, io.EOF
+			}
+			i++
+			return persons[i-1], nil
+		})
+		sorted := []person{}
+		for it.Next() {
+			sorted = append(sorted, it.Value().(person))
+		}
+		assert.NoError(t, it.Err())
+		assert.NoError(t, it.Close())
+		assert.Equal(t, expected, sorted)
+	}
+
+	// a failing source stops the sort
+	sourceErr := errors.New("source failed")
+	sorter := file.NewValueSorter(jsonCodec{}, less, file.WithChunkSize(16), file.WithTempDirs(file.ChunkDirs(t.TempDir())...))
+	it := sorter.Sort(ctx, func() (interface{}, error) {
+		return nil, sourceErr
+	})
+	assert.False(t, it.Next())
+	assert.True(t, errors.Is(it.Err(), sourceErr))
+	assert.NoError(t, it.Close())
+}
+
+func TestFraming(t *testing.T) {
+	ctx := context.Background()
+	// every record holds a newline, and all of them are 4 bytes long
+	records := []string{}
+	for i := 0; i < 100; i++ {
+		records = append(records, fmt.Sprintf("%03d\n", (i*37)%100))
+	}
+	sorted := make([]string, len(records))
+	copy(sorted, records)
+	sort.Strings(sorted)
+	for _, name := range []string{"nul", "length", "fixed:4"} {
+		for _, mergeWorkers := range []int{1, 3} {
+			name, mergeWorkers := name, mergeWorkers
+			t.Run(name+"_"+strconv.Itoa(mergeWorkers), func(t *testing.T) {
+				frame, err := framing.Parse(name)
+				assert.NoError(t, err)
+				input, expected := []byte{}, []byte{}
+				for i := range records {
+					input, err = frame.Append(input, records[i])
+					assert.NoError(t, err)
+					expected, err = frame.Append(expected, sorted[i])
+					assert.NoError(t, err)
+				}
+				dir := t.TempDir()
+				fI := &file.Info{
+					Reader:       bytes.NewReader(input),
+					Allocate:     vector.DefaultVector(key.AllocateString),
+					OutputPath:   path.Join(dir, "output"),
+					Framing:      frame,
+					MergeWorkers: mergeWorkers,
+				}
+				chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 21, 2)
+				assert.NoError(t, err)
+				assert.Len(t, chunkPaths, 5)
+				assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+				output, err := os.ReadFile(fI.OutputPath)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, output)
+			})
+		}
+	}
+
+	_, err := framing.Parse("fixed:0")
+	assert.Error(t, err)
+	// a fixed width input must hold whole records
+	fI := &file.Info{
+		Reader:     strings.NewReader("abcdab"),
+		Allocate:   vector.DefaultVector(key.AllocateString),
+		OutputPath: path.Join(t.TempDir(), "output"),
+		Framing:    framing.FixedWidth(4),
+	}
+	_, err = fI.CreateSortedChunks(ctx, file.ChunkDirs(t.TempDir()), 21, 2)
+	assert.True(t, errors.Is(err, framing.ErrTruncated))
+}
+
+func TestLongRecords(t *testing.T) {
+	ctx := context.Background()
+	// records over the 64 KiB of a default bufio.Scanner
+	const width = 100 << 10
+	records := []string{}
+	for i := 0; i < 10; i++ {
+		records = append(records, fmt.Sprintf("%03d\t", (i*7)%10)+strings.Repeat(string(rune('a'+i)), width-4))
+	}
+	sorted := make([]string, len(records))
+	copy(sorted, records)
+	sort.Strings(sorted)
+	for _, name := range []string{"newline", "nul", "length", "fixed:" + strconv.Itoa(width)} {
+		for _, mergeWorkers := range []int{1, 3} {
+			name, mergeWorkers := name, mergeWorkers
+			t.Run(name+"_"+strconv.Itoa(mergeWorkers), func(t *testing.T) {
+				frame, err := framing.Parse(name)
+				assert.NoError(t, err)
+				input, expected := []byte{}, []byte{}
+				for i := range records {
+					input, err = frame.Append(input, records[i])
+					assert.NoError(t, err)
+					expected, err = frame.Append(expected, sorted[i])
+					assert.NoError(t, err)
+				}
+				dir := t.TempDir()
+				fI := &file.Info{
+					Reader:       bytes.NewReader(input),
+					Allocate:     vector.DefaultVector(key.AllocateString),
+					OutputPath:   path.Join(dir, "output"),
+					Framing:      frame,
+					MergeWorkers: mergeWorkers,
+				}
+				chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 3, 2)
+				assert.NoError(t, err)
+				assert.Len(t, chunkPaths, 4)
+				assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 2))
+				output, err := os.ReadFile(fI.OutputPath)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, output)
+			})
+		}
+	}
+
+	// the sorter, its joins and its values read the same records
+	input := strings.Join(records, "\n") + "\n"
+	sorter := file.NewSorter(file.WithChunkSize(3), file.WithTempDirs(file.ChunkDirs(t.TempDir())...))
+	out := &bytes.Buffer{}
+	assert.NoError(t, sorter.Sort(ctx, strings.NewReader(input), out))
+	assert.Equal(t, strings.Join(sorted, "\n")+"\n", out.String())
+
+	join := file.Join{Type: file.InnerJoin, GroupRows: 1}
+	join.LeftKey = func(line string) (key.Key, error) {
+		return key.AllocateTsv(line, 0)
+	}
+	join.RightKey = join.LeftKey
+	joiner := file.NewJoiner(join, file.WithChunkSize(3), file.WithTempDirs(file.ChunkDirs(t.TempDir())...))
+	out = &bytes.Buffer{}
+	assert.NoError(t, joiner.Join(ctx, strings.NewReader(input), strings.NewReader(input), out))
+	assert.Equal(t, len(records), strings.Count(out.String(), "\n"))
+
+	valueSorter := file.NewValueSorter(jsonCodec{}, func(a, b interface{}) bool {
+		return a.(person).Name < b.(person).Name
+	}, file.WithChunkSize(3), file.WithTempDirs(file.ChunkDirs(t.TempDir())...))
+	i := 0
+	it := valueSorter.Sort(ctx, func() (interface{}, error) {
+		if i == len(records) {
+			return nil, io.EOF
+		}
+		i++
+		return person{Name: records[i-1]}, nil
+	})
+	values := []string{}
+	for it.Next() {
+		values = append(values, it.Value().(person).Name)
+	}
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, sorted, values)
+
+	// longer records than the maximum are an error
+	fI := &file.Info{
+		Reader:        strings.NewReader(input),
+		Allocate:      vector.DefaultVector(key.AllocateString),
+		OutputPath:    path.Join(t.TempDir(), "output"),
+		MaxRecordSize: width / 2,
+	}
+	_, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(t.TempDir()), 3, 2)
+	assert.True(t, errors.Is(err, bufio.ErrTooLong))
+
+	// a fixed width record is not cut
+	_, err = framing.FixedWidth(4).Append(nil, "abcde")
+	assert.True(t, errors.Is(err, framing.ErrTooLong))
+}
+
+func TestInputs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// 4 inputs of 25 rows
+	expected := []string{}
+	for i := 0; i < 4; i++ {
+		rows := ""
+		for j := 0; j < 25; j++ {
+			row := fmt.Sprintf("%03d", (i*25+j)*37%100)
+			rows += row + "\n"
+			expected = append(expected, row+"\t"+path.Join(dir, fmt.Sprintf("part-%d.tsv", i)))
+		}
+		assert.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("part-%d.tsv", i)), []byte(rows), 0o644))
+	}
+	sort.Strings(expected)
+	for _, chunkSize := range []int{7, 1000} {
+		chunkSize := chunkSize
+		t.Run(strconv.Itoa(chunkSize), func(t *testing.T) {
+			inputs, err := file.FileInputs(path.Join(dir, "part-*.tsv"))
+			assert.NoError(t, err)
+			assert.Len(t, inputs, 4)
+			fI := &file.Info{
+				Inputs: inputs,
+				Allocate: vector.DefaultVector(func(line string) (key.Key, error) {
+					return key.AllocateTsv(line, 0)
+				}),
+				OutputPath:   path.Join(t.TempDir(), "output.tsv"),
+				SourceColumn: true,
+			}
+			chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(t.TempDir()), chunkSize, 2)
+			assert.NoError(t, err)
+			assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+			output, err := os.ReadFile(fI.OutputPath)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Join(expected, "\n")+"\n", string(output))
+			assert.Equal(t, int64(100), fI.Stats().RowsRead)
+		})
+	}
+
+	_, err := file.FileInputs(path.Join(dir, "missing-*.tsv"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	// a bad row is reported with its input and its line in that input
+	assert.NoError(t, os.WriteFile(path.Join(dir, "bad.tsv"), []byte("1\n2\nx\n"), 0o644))
+	for _, chunkSize := range []int{7, 1000} {
+		inputs, err := file.FileInputs(path.Join(dir, "part-*.tsv"), path.Join(dir, "bad.tsv"))
+		assert.NoError(t, err)
+		fI := &file.Info{
+			Inputs:     inputs,
+			Allocate:   vector.DefaultVector(key.AllocateInt),
+			OutputPath: path.Join(t.TempDir(), "output.tsv"),
+		}
+		_, err = fI.CreateSortedChunks(ctx, file.ChunkDirs(t.TempDir()), chunkSize, 2)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "input "+path.Join(dir, "bad.tsv")+": line 3 (byte 4)")
+	}
+}
+
+func TestPartitioning(t *testing.T) {
+	ctx := context.Background()
+	// 20 keys of 5 rows
+	input := ""
+	for i := 0; i < 100; i++ {
+		input += fmt.Sprintf("%02d\t%d\n", (i*7)%20, i)
+	}
+	tcs := map[string]struct {
+		partitioning  file.Partitioning
+		expectedParts int
+	}{
+		"rows":  {partitioning: file.Partitioning{Rows: 12}, expectedParts: 7},
+		"size":  {partitioning: file.Partitioning{Size: 100}, expectedParts: 5},
+		"parts": {partitioning: file.Partitioning{Parts: 4}, expectedParts: 4},
+	}
+	for name, tc := range tcs {
+		tc := tc
+		for _, chunkSize := range []int{7, 1000} {
+			chunkSize := chunkSize
+			t.Run(name+"_"+strconv.Itoa(chunkSize), func(t *testing.T) {
+				dir := t.TempDir()
+				partitioning := tc.partitioning
+				partitioning.KeyText = func(line string) (string, error) {
+					return strings.SplitN(line, "\t", 2)[0], nil
+				}
+				fI := &file.Info{
+					Reader: strings.NewReader(input),
+					Allocate: vector.DefaultVector(func(line string) (key.Key, error) {
+						return key.AllocateTsv(line, 0)
+					}),
+					OutputPath:   path.Join(dir, "output.tsv"),
+					Partitioning: &partitioning,
+				}
+				chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), chunkSize, 2)
+				assert.NoError(t, err)
+				assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+				b, err := os.ReadFile(file.PartitionManifestPath(fI.OutputPath))
+				assert.NoError(t, err)
+				manifest := &file.PartitionManifest{}
+				assert.NoError(t, json.Unmarshal(b, manifest))
+				assert.Len(t, manifest.Parts, tc.expectedParts)
+				assert.Equal(t, "output-00000.tsv", path.Base(file.PartPath(fI.OutputPath, 0)))
+				keys := []string{}
+				previous := ""
+				for i, part := range manifest.Parts {
+					assert.Equal(t, path.Base(file.PartPath(fI.OutputPath, i)), part.Name)
+					b, err := os.ReadFile(path.Join(dir, part.Name))
+					assert.NoError(t, err)
+					assert.Equal(t, part.Size, int64(len(b)))
+					rows := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+					assert.Equal(t, part.Rows, int64(len(rows)))
+					// key ranges are increasing and never overlap
+					assert.Less(t, previous, part.MinKey)
+					assert.Equal(t, part.MinKey, strings.SplitN(rows[0], "\t", 2)[0])
+					assert.Equal(t, part.MaxKey, strings.SplitN(rows[len(rows)-1], "\t", 2)[0])
+					for _, row := range rows {
+						keys = append(keys, strings.SplitN(row, "\t", 2)[0])
+					}
+					previous = part.MaxKey
+				}
+				assert.Len(t, keys, 100)
+				assert.True(t, sort.StringsAreSorted(keys))
+				_, err = os.Stat(fI.OutputPath)
+				assert.True(t, os.IsNotExist(err))
+			})
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	ctx := context.Background()
+	// the empty group and the groups starting with _ get distinct files
+	customers := []string{"alice", "bob", "a/b", "", ".hidden", "_empty", "_SUCCESS"}
+	input := ""
+	expected := map[string][]string{}
+	for i := 0; i < 50; i++ {
+		customer := customers[(i*3)%len(customers)]
+		row := fmt.Sprintf("%s\t%02d", customer, i)
+		input += row + "\n"
+		expected[customer] = append(expected[customer], row)
+	}
+	column := func(pos int) func(line string) (string, error) {
+		return func(line string) (string, error) {
+			return strings.Split(line, "\t")[pos], nil
+		}
+	}
+	for chunkSize, ext := range map[int]string{7: "", 1000: ".csv"} {
+		chunkSize, ext := chunkSize, ext
+		t.Run(strconv.Itoa(chunkSize), func(t *testing.T) {
+			dir := t.TempDir()
+			fI := &file.Info{
+				Reader:         strings.NewReader(input),
+				Allocate:       vector.DefaultVector(key.AllocateString),
+				OutputPath:     path.Join(dir, "out"),
+				GroupBy:        column(0),
+				GroupExtension: ext,
+			}
+			if ext == "" {
+				ext = ".tsv"
+			}
+			chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), chunkSize, 2)
+			assert.NoError(t, err)
+			assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+			entries, err := os.ReadDir(fI.OutputPath)
+			assert.NoError(t, err)
+			assert.Len(t, entries, len(customers)+1)
+			assert.FileExists(t, path.Join(fI.OutputPath, file.GroupSuccessName))
+			for customer, rows := range expected {
+				b, err := os.ReadFile(file.GroupPath(fI.OutputPath, customer, ext))
+				assert.NoError(t, err)
+				sort.Strings(rows)
+				assert.Equal(t, strings.Join(rows, "\n")+"\n", string(b))
+			}
+		})
+	}
+
+	// the rows of a group must be consecutive
+	dir := t.TempDir()
+	fI := &file.Info{
+		Reader: strings.NewReader(input),
+		Allocate: vector.DefaultVector(func(line string) (key.Key, error) {
+			return key.AllocateTsv(line, 1)
+		}),
+		OutputPath: path.Join(dir, "out"),
+		GroupBy:    column(0),
+	}
+	chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 7, 2)
+	assert.NoError(t, err)
+	err = fI.MergeSort(ctx, chunkPaths, 10)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not consecutive")
+	_, err = os.Stat(path.Join(fI.OutputPath, file.GroupSuccessName))
+	assert.True(t, os.IsNotExist(err))
+
+	// a folder holding other files is refused
+	fI = &file.Info{
+		Reader:     strings.NewReader(input),
+		Allocate:   vector.DefaultVector(key.AllocateString),
+		OutputPath: path.Join(dir, "out"),
+		GroupBy:    column(0),
+	}
+	chunkPaths, err = fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 7, 2)
+	assert.NoError(t, err)
+	err = fI.MergeSort(ctx, chunkPaths, 10)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not empty")
+
+	// the groups are only written to local files
+	fI = &file.Info{
+		Reader:     strings.NewReader(input),
+		Allocate:   vector.DefaultVector(key.AllocateString),
+		OutputPath: path.Join(dir, "other"),
+		GroupBy:    column(0),
+		OpenOutput: file.CreateAtomicFile,
+	}
+	chunkPaths, err = fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 7, 2)
+	assert.NoError(t, err)
+	err = fI.MergeSort(ctx, chunkPaths, 10)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "OpenOutput")
+}
+
+func TestJoin(t *testing.T) {
+	ctx := context.Background()
+	left := "e\tl5\nb\tl2\na\tl1\nc\tl4\nb\tl3\n"
+	right := "d\tr5\nb\tr1\nc\tr4\nb\tr3\nb\tr2\n"
+	matched := []string{
+		"b\tl2\tb\tr1", "b\tl2\tb\tr2", "b\tl2\tb\tr3",
+		"b\tl3\tb\tr1", "b\tl3\tb\tr2", "b\tl3\tb\tr3",
+		"c\tl4\tc\tr4",
+	}
+	tcs := map[string]struct {
+		join     file.Join
+		expected []string
+	}{
+		"inner": {join: file.Join{Type: file.InnerJoin}, expected: matched},
+		"left":  {join: file.Join{Type: file.LeftJoin}, expected: append([]string{"a\tl1\t", "e\tl5\t"}, matched...)},
+		"right": {join: file.Join{Type: file.RightJoin}, expected: append([]string{"\td\tr5"}, matched...)},
+		"full":  {join: file.Join{Type: file.FullJoin}, expected: append([]string{"a\tl1\t", "e\tl5\t", "\td\tr5"}, matched...)},
+		// groups of more than one row are spilled to disk
+		"spill": {join: file.Join{Type: file.InnerJoin, GroupRows: 1}, expected: matched},
+		"columns": {
+			join: file.Join{Type: file.FullJoin, Columns: []file.JoinColumn{{Column: 0}, {Column: 1}, {Right: true, Column: 1}}},
+			expected: []string{
+				"a\tl1\t", "e\tl5\t", "\t\tr5",
+				"b\tl2\tr1", "b\tl2\tr2", "b\tl2\tr3",
+				"b\tl3\tr1", "b\tl3\tr2", "b\tl3\tr3",
+				"c\tl4\tr4",
+			},
+		},
+	}
+	for name, tc := range tcs {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			join := tc.join
+			join.LeftKey = func(line string) (key.Key, error) {
+				return key.AllocateTsv(line, 0)
+			}
+			join.RightKey = join.LeftKey
+			dir := t.TempDir()
+			joiner := file.NewJoiner(join, file.WithChunkSize(2), file.WithTempDirs(file.ChunkDirs(dir)...))
+			out := &bytes.Buffer{}
+			assert.NoError(t, joiner.Join(ctx, strings.NewReader(left), strings.NewReader(right), out))
+			// the sorted inputs and the spilled groups are removed
+			entries, err := os.ReadDir(dir)
+			assert.NoError(t, err)
+			assert.Empty(t, entries)
+			rows := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			assert.ElementsMatch(t, tc.expected, rows)
+		})
+	}
+
+	// the sorted sides are streamed, the failure of one side stops the other one
+	join := file.Join{Type: file.FullJoin}
+	join.LeftKey = func(line string) (key.Key, error) {
+		return key.AllocateTsv(line, 0)
+	}
+	join.RightKey = join.LeftKey
+	dir := t.TempDir()
+	joiner := file.NewJoiner(join, file.WithChunkSize(2), file.WithTempDirs(file.ChunkDirs(dir)...))
+	err := joiner.Join(ctx, strings.NewReader(left), failingReader{}, &bytes.Buffer{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "input should not be read")
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	a := "f\t7\nc\t4\na\t1\nb\t2\nd\t5\nc\t3\n"
+	b := "g\t2\nc\t9\ne\t6\nb\t2\nf\t8\nc\t3\ng\t1\n"
+	expected := "-\ta\t1\n" +
+		"<\tc\t4\n>\tc\t9\n" +
+		"-\td\t5\n" +
+		"+\te\t6\n" +
+		"<\tf\t7\n>\tf\t8\n" +
+		"+\tg\t1\n+\tg\t2\n"
+	key0 := func(line string) (key.Key, error) {
+		return key.AllocateTsv(line, 0)
+	}
+	for _, chunkSize := range []int{2, 1000} {
+		chunkSize := chunkSize
+		t.Run(fmt.Sprintf("chunk_%d", chunkSize), func(t *testing.T) {
+			dir := t.TempDir()
+			differ := file.NewDiffer(key0, key0, file.WithChunkSize(chunkSize), file.WithTempDirs(file.ChunkDirs(dir)...))
+			out := &bytes.Buffer{}
+			summary, err := differ.Diff(ctx, strings.NewReader(a), strings.NewReader(b), out)
+			assert.NoError(t, err)
+			assert.Equal(t, file.DiffSummary{OnlyA: 2, OnlyB: 3, Changed: 2, Same: 2}, summary)
+			assert.Equal(t, expected, out.String())
+			// the sorted inputs are removed
+			entries, err := os.ReadDir(dir)
+			assert.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+
+	// the changed rows of a key past the group limit are spilled to disk
+	a, b = "", ""
+	expected = ""
+	for i := 0; i < 100; i++ {
+		a += fmt.Sprintf("k\ta%03d\n", i)
+		b += fmt.Sprintf("k\tb%03d\n", i)
+		expected += fmt.Sprintf("<\tk\ta%03d\n>\tk\tb%03d\n", i, i)
+	}
+	b += "k\tb100\nk\tb101\n"
+	expected += "+\tk\tb100\n+\tk\tb101\n"
+	dir := t.TempDir()
+	differ := file.NewDiffer(key0, key0, file.WithChunkSize(16), file.WithGroupRows(10), file.WithTempDirs(file.ChunkDirs(dir)...))
+	out := &bytes.Buffer{}
+	summary, err := differ.Diff(ctx, strings.NewReader(a), strings.NewReader(b), out)
+	assert.NoError(t, err)
+	assert.Equal(t, file.DiffSummary{OnlyB: 2, Changed: 100}, summary)
+	assert.Equal(t, expected, out.String())
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// no temporary folder uses the system one
+	differ = file.NewDiffer(key0, key0, file.WithChunkSize(16), file.WithGroupRows(10), file.WithTempDirs())
+	out = &bytes.Buffer{}
+	summary, err = differ.Diff(ctx, strings.NewReader(a), strings.NewReader(b), out)
+	assert.NoError(t, err)
+	assert.Equal(t, file.DiffSummary{OnlyB: 2, Changed: 100}, summary)
+	assert.Equal(t, expected, out.String())
+}
+
+func TestReduce(t *testing.T) {
+	ctx := context.Background()
+	input := ""
+	for i := 0; i < 60; i++ {
+		input += fmt.Sprintf("k%d\t%d\n", i%4, i)
+	}
+	tcs := map[string]struct {
+		reduce   file.Reducer
+		expected string
+	}{
+		"count": {reduce: file.Count{}, expected: "k0\t15\nk1\t15\nk2\t15\nk3\t15\n"},
+		"sum":   {reduce: file.Sum{Column: 1}, expected: "k0\t420\nk1\t435\nk2\t450\nk3\t465\n"},
+		"min":   {reduce: file.Min{Column: 1}, expected: "k0\t0\nk1\t1\nk2\t2\nk3\t3\n"},
+		"max":   {reduce: file.Max{Column: 1}, expected: "k0\t56\nk1\t57\nk2\t58\nk3\t59\n"},
+		// the rows of a key are merged in the order of the input
+		"first": {reduce: file.First{}, expected: "k0\t0\nk1\t1\nk2\t2\nk3\t3\n"},
+		"last":  {reduce: file.Last{}, expected: "k0\t56\nk1\t57\nk2\t58\nk3\t59\n"},
+	}
+	key0 := func(line string) (key.Key, error) {
+		return key.AllocateTsv(line, 0)
+	}
+	for name, tc := range tcs {
+		tc := tc
+		for _, chunkSize := range []int{7, 1000} {
+			for _, combine := range []bool{false, true} {
+				chunkSize, combine := chunkSize, combine
+				t.Run(fmt.Sprintf("%s_%d_%t", name, chunkSize, combine), func(t *testing.T) {
+					out := &bytes.Buffer{}
+					sorter := file.NewSorter(
+						file.WithKey(key0),
+						file.WithChunkSize(chunkSize),
+						file.WithWorkers(2, 2),
+						file.WithTempDirs(file.ChunkDirs(t.TempDir())...),
+						file.WithReducer(tc.reduce, combine),
+					)
+					assert.NoError(t, sorter.Sort(ctx, strings.NewReader(input), out))
+					output := out.String()
+					if name == "count" {
+						// the count follows the columns of any row of the key
+						rows := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+						for i := range rows {
+							columns := strings.Split(rows[i], "\t")
+							rows[i] = columns[0] + "\t" + columns[2]
+						}
+						output = strings.Join(rows, "\n") + "\n"
+					}
+					assert.Equal(t, tc.expected, output)
+				})
+			}
+		}
+	}
+
+	// distinct values of a column
+	out := &bytes.Buffer{}
+	sorter := file.NewSorter(file.WithKey(key0), file.WithChunkSize(3), file.WithTempDirs(file.ChunkDirs(t.TempDir())...),
+		file.WithReducer(file.ConcatDistinct{Column: 1, Sep: ","}, true))
+	assert.NoError(t, sorter.Sort(ctx, strings.NewReader("b\tx\na\ty\nb\tz\na\ty\nb\tx\n"), out))
+	assert.Equal(t, "a\ty\nb\tx,z\n", out.String())
+	// integers beyond 2^53 are summed without losing precision
+	out.Reset()
+	sorter = file.NewSorter(file.WithKey(key0), file.WithChunkSize(1), file.WithTempDirs(file.ChunkDirs(t.TempDir())...),
+		file.WithReducer(file.Sum{Column: 1}, false))
+	assert.NoError(t, sorter.Sort(ctx, strings.NewReader("a\t9007199254740993\na\t1\n"), out))
+	assert.Equal(t, "a\t9007199254740994\n", out.String())
+	// a reducer can not be limited
+	fI := &file.Info{
+		Reader:   strings.NewReader(input),
+		Allocate: vector.DefaultVector(key0),
+		Reduce:   file.Count{},
+		Limit:    2,
+	}
+	_, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(t.TempDir()), 7, 2)
+	assert.Error(t, err)
+}
+
+func TestSFTPOutput(t *testing.T) {
+	ctx := context.Background()
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.InMemHandler())
+	go server.Serve()
+	defer server.Close()
+	c, err := sftp.NewClientPipe(clientConn, clientConn)
+	assert.NoError(t, err)
+	defer c.Close()
+	client := &xsftp.Client{Client: c}
+	put := func(p, content string) {
+		f, err := c.Create(p)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(content))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+	get := func(p string) string {
+		f, err := c.Open(p)
+		assert.NoError(t, err)
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		return string(b)
+	}
+	names := func() []string {
+		infos, err := c.ReadDir("/")
+		assert.NoError(t, err)
+		res := []string{}
+		for _, info := range infos {
+			res = append(res, info.Name())
+		}
+		sort.Strings(res)
+		return res
+	}
+	put("/in.tsv", "c\nb\na\nd\n")
+	put("/out.tsv", "old\n")
+
+	inputs, err := client.Inputs("/in.tsv")
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	fI := &file.Info{
+		Inputs:       inputs,
+		Allocate:     vector.DefaultVector(key.AllocateString),
+		OutputPath:   "/out.tsv",
+		OpenOutput:   client.OpenOutput,
+		MergeWorkers: 2,
+	}
+	chunkPaths, err := fI.CreateSortedChunks(ctx, file.ChunkDirs(path.Join(dir, "chunks")), 2, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, fI.MergeSort(ctx, chunkPaths, 10))
+	assert.Equal(t, "a\nb\nc\nd\n", get("/out.tsv"))
+	assert.Equal(t, []string{"in.tsv", "out.tsv"}, names())
+
+	// an aborted output leaves the previous one in place
+	w, err := client.CreateAtomic("/out.tsv")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("new\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{".out.tsv.tmp-", "in.tsv", "out.tsv"}, trimSuffixes(names()))
+	assert.NoError(t, w.Abort())
+	assert.Equal(t, "a\nb\nc\nd\n", get("/out.tsv"))
+	assert.Equal(t, []string{"in.tsv", "out.tsv"}, names())
+}
+
+// trimSuffixes removes the random part of the temporary names.
+func trimSuffixes(names []string) []string {
+	res := []string{}
+	for _, name := range names {
+		if i := strings.Index(name, ".tmp-"); i >= 0 {
+			name = name[:i+len(".tmp-")]
+		}
+		res = append(res, name)
+	}
+	return res
+}
@@ -1,13 +1,25 @@
 package sftp
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
 
+	"github.com/askiada/external-sort/file"
+	"github.com/pkg/errors"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
+const (
+	posixRenameExtension = "posix-rename@openssh.com"
+	fsyncExtension       = "fsync@openssh.com"
+)
+
 type Client struct {
 	Conn   *ssh.Client
 	Client *sftp.Client
@@ -48,3 +60,137 @@ func (s *Client) Close() error {
 	}
 	return s.Conn.Close()
 }
+
+// Inputs returns an input for every remote file matching the patterns, in order.
+// A pattern matching no file is an error.
+func (s *Client) Inputs(patterns ...string) ([]file.Input, error) {
+	fn := "sftp inputs"
+	inputs := []file.Input{}
+	for _, pattern := range patterns {
+		paths, err := s.Client.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, fn)
+		}
+		if len(paths) == 0 {
+			return nil, errors.Wrapf(os.ErrNotExist, "%s: %s", fn, pattern)
+		}
+		for _, p := range paths {
+			stat, err := s.Client.Stat(p)
+			if err != nil {
+				return nil, errors.Wrap(err, fn)
+			}
+			p := p
+			inputs = append(inputs, file.Input{
+				Name: p,
+				Size: stat.Size(),
+				Open: func() (io.ReadCloser, error) {
+					return s.Client.Open(p)
+				},
+			})
+		}
+	}
+	return inputs, nil
+}
+
+// AtomicFile is a remote file written under a temporary name.
+// It replaces its final path only when Commit is called.
+type AtomicFile struct {
+	client     *sftp.Client
+	file       *sftp.File
+	remotePath string
+	// suffix is the random part of the temporary name.
+	suffix string
+}
+
+// CreateAtomic Create a temporary file in the same remote directory as remotePath.
+func (s *Client) CreateAtomic(remotePath string) (*AtomicFile, error) {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, errors.Wrap(err, "create atomic")
+	}
+	suffix := hex.EncodeToString(random)
+	dir, base := path.Split(remotePath)
+	tmpPath := path.Join(dir, "."+base+".tmp-"+suffix)
+	f, err := s.Client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, errors.Wrap(err, "create atomic")
+	}
+	return &AtomicFile{client: s.Client, file: f, remotePath: remotePath, suffix: suffix}, nil
+}
+
+// OpenOutput Create the output at remotePath with CreateAtomic.
+func (s *Client) OpenOutput(remotePath string) (file.AtomicWriter, error) {
+	return s.CreateAtomic(remotePath)
+}
+
+func (a *AtomicFile) Write(p []byte) (int, error) {
+	return a.file.Write(p)
+}
+
+// WriteAt Write p at the offset off of the temporary file.
+func (a *AtomicFile) WriteAt(p []byte, off int64) (int, error) {
+	return a.file.WriteAt(p, off)
+}
+
+// Commit Sync the temporary file when the server supports it and rename it to its final path.
+// Without the posix-rename extension, an existing file is renamed aside first and put back
+// if the temporary file can not take its place.
+func (a *AtomicFile) Commit() error {
+	fn := "commit"
+	tmpPath := a.file.Name()
+	if _, ok := a.client.HasExtension(fsyncExtension); ok {
+		err := a.file.Sync()
+		if err != nil {
+			a.Abort()
+			return errors.Wrap(err, fn)
+		}
+	}
+	err := a.file.Close()
+	if err != nil {
+		a.client.Remove(tmpPath)
+		return errors.Wrap(err, fn)
+	}
+	if _, ok := a.client.HasExtension(posixRenameExtension); ok {
+		err = a.client.PosixRename(tmpPath, a.remotePath)
+	} else {
+		err = a.replace(tmpPath)
+	}
+	if err != nil {
+		a.client.Remove(tmpPath)
+		return errors.Wrap(err, fn)
+	}
+	return nil
+}
+
+// replace Rename tmpPath to the final path, keeping the previous file under a backup name
+// until the rename succeeded.
+func (a *AtomicFile) replace(tmpPath string) error {
+	dir, base := path.Split(a.remotePath)
+	backupPath := path.Join(dir, "."+base+".old-"+a.suffix)
+	err := a.client.Rename(a.remotePath, backupPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return a.client.Rename(tmpPath, a.remotePath)
+	}
+	if err != nil {
+		return err
+	}
+	err = a.client.Rename(tmpPath, a.remotePath)
+	if err != nil {
+		a.client.Rename(backupPath, a.remotePath)
+		return err
+	}
+	// the new file is in place, a backup left behind does not change the output
+	a.client.Remove(backupPath)
+	return nil
+}
+
+// Abort Close and remove the temporary file. The final path is left untouched.
+func (a *AtomicFile) Abort() error {
+	a.file.Close()
+	err := a.client.Remove(a.file.Name())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrap(err, "abort")
+	}
+	return nil
+}
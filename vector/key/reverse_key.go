@@ -0,0 +1,21 @@
+package key
+
+// Reverse Invert the order of a key.
+type Reverse struct {
+	key Key
+}
+
+// AllocateReverse returns an allocator of keys sorted in the reverse order of the keys created by allocate.
+func AllocateReverse(allocate func(line string) (Key, error)) func(line string) (Key, error) {
+	return func(line string) (Key, error) {
+		k, err := allocate(line)
+		if err != nil {
+			return nil, err
+		}
+		return &Reverse{k}, nil
+	}
+}
+
+func (k *Reverse) Less(other Key) bool {
+	return other.(*Reverse).key.Less(k.key)
+}
@@ -47,6 +47,18 @@ func (v *SliceVec) Sort() {
 	})
 }
 
+func (v *SliceVec) SortStable() {
+	sort.SliceStable(v.s, func(i, j int) bool {
+		return Less(v.Get(i), v.Get(j))
+	})
+}
+
+func (v *SliceVec) Truncate(n int) {
+	if n < len(v.s) {
+		v.s = v.s[:n]
+	}
+}
+
 func (v *SliceVec) FrontShift() {
 	v.s = v.s[1:]
 }
@@ -1,11 +1,7 @@
 package vector
 
 import (
-	"bufio"
-	"os"
-
 	"github.com/askiada/external-sort/vector/key"
-	"github.com/pkg/errors"
 )
 
 type Allocate struct {
@@ -33,21 +29,8 @@ type Vector interface {
 	Reset()
 	// Sort sort the vector in ascending order
 	Sort()
-}
-
-func Dump(v Vector, filename string) error {
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0o644)
-	if err != nil {
-		return errors.Errorf("failed creating file: %s", err)
-	}
-	datawriter := bufio.NewWriter(file)
-	for i := 0; i < v.Len(); i++ {
-		_, err = datawriter.WriteString(v.Get(i).Line + "\n")
-		if err != nil {
-			return errors.Errorf("failed writing file: %s", err)
-		}
-	}
-	datawriter.Flush()
-	file.Close()
-	return nil
+	// SortStable sort the vector in ascending order, keeping the order of equal elements
+	SortStable()
+	// Truncate Keep only the first n elements
+	Truncate(n int)
 }